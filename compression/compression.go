@@ -0,0 +1,139 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec compresses the serialized messages of a topic.
+type Codec uint8
+
+const (
+	None Codec = iota
+	Gzip
+	Zstd
+	LZ4
+)
+
+// MaxDecompressedSize bounds the size of a decompressed message.
+const MaxDecompressedSize = 256 << 20
+
+var ErrTooLarge = errors.New("compression: decompressed message too large")
+
+var names = map[Codec]string{
+	None: "none",
+	Gzip: "gzip",
+	Zstd: "zstd",
+	LZ4:  "lz4",
+}
+
+// Parse returns the codec of a "compression" config value, "" meaning none.
+func Parse(name string) (Codec, error) {
+	if name == "" {
+		return None, nil
+	}
+	for c, n := range names {
+		if n == name {
+			return c, nil
+		}
+	}
+	return None, fmt.Errorf("unsupported compression \"%s\"", name)
+}
+
+func (c Codec) String() string {
+	if n, ok := names[c]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+// zstd encoders and decoders are safe for concurrent EncodeAll and DecodeAll
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() {
+	zstdEncoder, zstdErr = zstd.NewWriter(nil)
+	if zstdErr != nil {
+		return
+	}
+	zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecompressedSize))
+}
+
+func (c Codec) Compress(data []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return data, nil
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		zstdOnce.Do(initZstd)
+		if zstdErr != nil {
+			return nil, zstdErr
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case LZ4:
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s", c)
+}
+
+func (c Codec) Decompress(data []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return data, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readAllLimited(r)
+	case Zstd:
+		zstdOnce.Do(initZstd)
+		if zstdErr != nil {
+			return nil, zstdErr
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	case LZ4:
+		return readAllLimited(lz4.NewReader(bytes.NewReader(data)))
+	}
+	return nil, fmt.Errorf("unsupported compression %s", c)
+}
+
+func readAllLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxDecompressedSize {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,52 @@
+package compression
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("autoware_planning_msgs/msg/Trajectory "), 1000)
+	for _, name := range []string{"none", "gzip", "zstd", "lz4"} {
+		t.Run(name, func(t *testing.T) {
+			c, err := Parse(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.String() != name {
+				t.Errorf("expected %s, got %s", name, c)
+			}
+			compressed, err := c.Compress(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c != None && len(compressed) >= len(data) {
+				t.Errorf("%d bytes compressed into %d", len(data), len(compressed))
+			}
+			got, err := c.Decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("round trip mismatch")
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	if c, err := Parse(""); err != nil || c != None {
+		t.Errorf("expected none for an empty name, got %s, %v", c, err)
+	}
+	if _, err := Parse("brotli"); err == nil {
+		t.Error("expected an error for an unsupported compression")
+	}
+}
+
+func TestDecompressCorrupted(t *testing.T) {
+	for _, c := range []Codec{Gzip, Zstd, LZ4} {
+		if _, err := c.Decompress([]byte("not compressed")); err == nil {
+			t.Errorf("%s: expected an error for corrupted data", c)
+		}
+	}
+}
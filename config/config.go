@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
 	"io"
 	"log/slog"
 	"net"
@@ -12,30 +13,182 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/3DRX/webrtc-ros-bridge/compression"
 	"github.com/3DRX/webrtc-ros-bridge/consts"
+	"github.com/3DRX/webrtc-ros-bridge/registry"
 	"github.com/tiiuae/rclgo/pkg/rclgo"
 )
 
 
 type ImageSpecifications struct {
+	// the sender discovers the size and frame rate of the topic when they are 0
 	Width      int      `json:"width"`
 	Height     int      `json:"height"`
 	FrameRate  float64  `json:"frame_rate"`
+	Codec      string   `json:"codec"` // "vp8" (default), "vp9", "h264" or "av1", chosen by the sender
+	// encoder settings of the sender, zero values keep the codec's defaults
+	BitRate          int    `json:"bitrate"`           // bits per second, caps the adaptive bitrate of the topic
+	KeyFrameInterval int    `json:"keyframe_interval"` // frames between keyframes
+	RateControl      string `json:"rate_control"`      // "cbr" or "vbr", vp8, vp9 and h264 only
+	Deadline         string `json:"deadline"`          // "realtime", "good" or "best", vp8 and vp9 only
+	Preset           int    `json:"preset"`            // speed preset from 1 (slowest) to 13 (fastest), av1 only
+	ErrorResilient   bool   `json:"error_resilient"`   // vp8 and vp9 only
+	// mapping of single channel images such as 16UC1 or 32FC1 depth images
+	DepthMin float64 `json:"depth_min"` // value shown as the start of the colormap
+	DepthMax float64 `json:"depth_max"` // value shown as the end of the colormap, equal bounds use the range of each frame
+	Colormap string  `json:"colormap"`  // "gray" (default) or "jet"
+	// size of the video sent, the image (or its crop) is scaled to fit it
+	OutputWidth   int    `json:"output_width"`
+	OutputHeight  int    `json:"output_height"`
+	Crop          *Rect  `json:"crop"`           // part of the image sent, the receiver can change it at runtime
+	ScalingFilter string `json:"scaling_filter"` // "bilinear" (default), "nearest" or "area"
+	// CompressedImage topics only: send the JPEG or PNG frames unchanged on a data channel
+	// rather than decoding them into a video track
+	Passthrough bool `json:"passthrough"`
+}
+
+// Rect is a rectangle of an image in pixels.
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Rectangle returns r as an image.Rectangle.
+func (r *Rect) Rectangle() image.Rectangle {
+	return image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+}
+
+// VideoSize returns the size of the video of an image topic: the output
+// size, else the size of the crop, else the size of the image, 0 when it has
+// to be discovered from the topic.
+func (s *ImageSpecifications) VideoSize() (int, int) {
+	switch {
+	case s.OutputWidth > 0:
+		return s.OutputWidth, s.OutputHeight
+	case s.Crop != nil:
+		return s.Crop.Width, s.Crop.Height
+	}
+	return s.Width, s.Height
 }
 type TopicConfig struct {
 	NameIn  string              `json:"name_in"`
 	NameOut string              `json:"name_out"`
-	Type    string              `json:"type"`       // only "sensor_msgs/msg/Image" is supported
-	ImgSpec ImageSpecifications `json:"image_spec"` // only valid when type is "Image"
+	Type    string              `json:"type"`
+	ImgSpec ImageSpecifications `json:"image_spec"` // only valid when type is "Image" or "CompressedImage"
 	Qos     *rclgo.QosProfile   `json:"qos"`
+	// either "to_receiver" (default) or "to_sender", only data topics can be sent to the sender
+	Direction string `json:"direction"`
+	// "high", "normal" or "low", defaults to "high" for control-critical types and "normal" otherwise
+	Priority string `json:"priority"`
+	// "none" (default), "zstd", "lz4" or "gzip", must match on both bridges
+	Compression string `json:"compression"`
+	// the sender forwards at most max_rate_hz messages per second (0 for no limit),
+	// keeping the latest message of each interval
+	MaxRateHz float64 `json:"max_rate_hz"`
+	// the sender forwards only every n-th message (0 or 1 to keep every message)
+	KeepEveryN int `json:"keep_every_n"`
+}
+
+const (
+	DirectionToReceiver = "to_receiver"
+	DirectionToSender   = "to_sender"
+)
+
+const (
+	VideoCodecVP8  = "vp8"
+	VideoCodecVP9  = "vp9"
+	VideoCodecH264 = "h264"
+	VideoCodecAV1  = "av1"
+)
+
+const (
+	RateControlCBR = "cbr"
+	RateControlVBR = "vbr"
+)
+
+const (
+	DeadlineRealtime = "realtime"
+	DeadlineGood     = "good"
+	DeadlineBest     = "best"
+)
+
+const (
+	ColormapGray = "gray"
+	ColormapJet  = "jet"
+)
+
+const (
+	ScalingFilterBilinear = "bilinear"
+	ScalingFilterNearest  = "nearest"
+	ScalingFilterArea     = "area"
+)
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// SubscribedBy reports whether the bridge running in mode subscribes to the
+// topic, rather than publishing it.
+func (t *TopicConfig) SubscribedBy(mode string) bool {
+	if t.Direction == DirectionToSender {
+		return mode == "receiver"
+	}
+	return mode == "sender"
+}
+
+// IsVideo reports whether the sender streams the topic as a video track:
+// Image topics, and CompressedImage topics unless passed through.
+func (t *TopicConfig) IsVideo() bool {
+	return t.Type == consts.MSG_IMAGE || (t.Type == consts.MSG_COMPRESSED_IMAGE && !t.ImgSpec.Passthrough)
+}
+
+// Codec returns the compression of the serialized messages of the topic.
+func (t *TopicConfig) Codec() compression.Codec {
+	codec, err := compression.Parse(t.Compression)
+	if err != nil {
+		panic(err) // rejected by checkCfg
+	}
+	return codec
+}
+
+// WireName is the name the topic goes by between the bridges: the name_out
+// of the subscribing side, which is the name_in of the publishing side.
+func (t *TopicConfig) WireName(mode string) string {
+	if t.SubscribedBy(mode) {
+		return t.NameOut
+	}
+	return t.NameIn
 }
 
 type Config struct {
 	Mode   string        `json:"mode"` // either "sender" or "receiver"
 	Addr   string        `json:"addr"` // http service address
 	Topics []TopicConfig `json:"topics"`
+	// resolve types without generated bindings at runtime and bridge them serialized
+	DynamicTypes bool `json:"dynamic_types"`
+	// receivers a sender serves at the same time, defaults to 1
+	MaxReceivers int `json:"max_receivers"`
+	// STUN and TURN servers, defaults to a public STUN server when absent
+	ICEServers []ICEServerConfig `json:"ice_servers"`
+	// either "all" (default) or "relay" to only connect through TURN
+	ICETransportPolicy string `json:"ice_transport_policy"`
+	// only gather host candidates, for peers on the same network
+	HostOnly bool `json:"host_only"`
+	// bounds in bits per second of the video bitrate, which follows the
+	// bandwidth estimated by congestion control
+	MinBitrate int `json:"min_bitrate"`
+	MaxBitrate int `json:"max_bitrate"`
 }
 
+const (
+	DefaultMinBitrate = 300_000
+	DefaultMaxBitrate = 5_000_000
+)
+
 func isTopicNameValid(topic_name *string) bool {
 	re := regexp.MustCompile(`^[a-z0-9_\-]+(/[a-z0-9_\-]+)*$`)
 	if *topic_name == "" {
@@ -120,6 +273,72 @@ func isValidQosProfile(qos *rclgo.QosProfile) bool {
 		    (qos.Durability >= 0 && qos.Durability <= 3)
 }
 
+func checkEncoder(spec *ImageSpecifications) error {
+	if spec.BitRate < 0 || spec.KeyFrameInterval < 0 {
+		return fmt.Errorf(fmt.Sprintf("wrong encoder params: bitrate %d, keyframe_interval %d", spec.BitRate, spec.KeyFrameInterval))
+	}
+	switch spec.RateControl {
+	case "", RateControlCBR, RateControlVBR:
+	default:
+		return fmt.Errorf("wrong rate_control, expected \"cbr\" or \"vbr\", but find \"" + spec.RateControl + "\"")
+	}
+	switch spec.Deadline {
+	case "", DeadlineRealtime, DeadlineGood, DeadlineBest:
+	default:
+		return fmt.Errorf("wrong deadline, expected \"realtime\", \"good\" or \"best\", but find \"" + spec.Deadline + "\"")
+	}
+	if spec.Preset < 0 || spec.Preset > 13 {
+		return fmt.Errorf("wrong preset %d, expected 1 to 13", spec.Preset)
+	}
+	// options only some codecs have are rejected rather than ignored
+	codec := spec.Codec
+	if codec == "" {
+		codec = VideoCodecVP8
+	}
+	vpx := codec == VideoCodecVP8 || codec == VideoCodecVP9
+	switch {
+	case spec.RateControl == RateControlVBR && codec == VideoCodecH264:
+		// openh264's quality mode doesn't keep to the bitrate set by congestion control
+		return fmt.Errorf("rate_control \"vbr\" isn't supported by h264")
+	case spec.RateControl != "" && codec == VideoCodecAV1:
+		return fmt.Errorf("rate_control isn't supported by av1")
+	case spec.Deadline != "" && !vpx:
+		return fmt.Errorf("deadline is only supported by vp8 and vp9")
+	case spec.ErrorResilient && !vpx:
+		return fmt.Errorf("error_resilient is only supported by vp8 and vp9")
+	case spec.Preset != 0 && codec != VideoCodecAV1:
+		return fmt.Errorf("preset is only supported by av1")
+	}
+	return nil
+}
+
+func checkDepthMapping(spec *ImageSpecifications) error {
+	if spec.DepthMin > spec.DepthMax {
+		return fmt.Errorf("invalid depth bounds %f..%f", spec.DepthMin, spec.DepthMax)
+	}
+	switch spec.Colormap {
+	case "", ColormapGray, ColormapJet:
+	default:
+		return fmt.Errorf("wrong colormap, expected \"gray\" or \"jet\", but find \"" + spec.Colormap + "\"")
+	}
+	return nil
+}
+
+func checkScaling(spec *ImageSpecifications) error {
+	if spec.OutputWidth < 0 || spec.OutputHeight < 0 || (spec.OutputWidth == 0) != (spec.OutputHeight == 0) {
+		return fmt.Errorf("wrong output size %dx%d", spec.OutputWidth, spec.OutputHeight)
+	}
+	if crop := spec.Crop; crop != nil && (crop.X < 0 || crop.Y < 0 || crop.Width <= 0 || crop.Height <= 0) {
+		return fmt.Errorf("wrong crop %dx%d at (%d, %d)", crop.Width, crop.Height, crop.X, crop.Y)
+	}
+	switch spec.ScalingFilter {
+	case "", ScalingFilterBilinear, ScalingFilterNearest, ScalingFilterArea:
+	default:
+		return fmt.Errorf("wrong scaling_filter, expected \"bilinear\", \"nearest\" or \"area\", but find \"" + spec.ScalingFilter + "\"")
+	}
+	return nil
+}
+
 func checkCfg(c *Config) error {
 	if !(c.Mode == "sender" || c.Mode == "receiver") {
 		return fmt.Errorf("wrong Mode syntax, expected \"sender\" or \"receiver\", but find \"" + c.Mode + "\"")
@@ -127,21 +346,99 @@ func checkCfg(c *Config) error {
 	if !isValidAddr(&c.Addr) {
 		return fmt.Errorf("invalid ipv4 addr \"" + c.Addr + "\"")
 	}
-	for _, topic := range c.Topics {
+	if c.MaxReceivers < 0 {
+		return fmt.Errorf("invalid max_receivers %d", c.MaxReceivers)
+	}
+	if c.MaxReceivers == 0 {
+		c.MaxReceivers = 1
+	}
+	if c.MinBitrate == 0 {
+		c.MinBitrate = DefaultMinBitrate
+	}
+	if c.MaxBitrate == 0 {
+		c.MaxBitrate = max(DefaultMaxBitrate, c.MinBitrate)
+	}
+	if c.MinBitrate < 0 || c.MaxBitrate < c.MinBitrate {
+		return fmt.Errorf("invalid bitrate bounds %d..%d", c.MinBitrate, c.MaxBitrate)
+	}
+	if err := checkICE(c); err != nil {
+		return err
+	}
+	for i, topic := range c.Topics {
 		if !isTopicNameValid(&topic.NameIn) || !isTopicNameValid(&topic.NameOut) {
 			return fmt.Errorf("wrong topic name format: \"" + topic.NameIn + "\" or \"" + topic.NameOut + "\"")
 		}
-		switch topic.Type {
-		case consts.MSG_IMAGE:
+		if !registry.IsSupported(topic.Type) &&
+			!(c.DynamicTypes && registry.IsValidTypeName(topic.Type)) {
+			return fmt.Errorf("unsupported topic type: \"" + topic.Type + "\"")
+		}
+		if topic.ImgSpec.Passthrough && topic.Type != consts.MSG_COMPRESSED_IMAGE {
+			return fmt.Errorf("topic \"" + topic.NameIn + "\" can't be passed through, only CompressedImage topics can")
+		}
+		if c.Mode == "receiver" && topic.Type == consts.MSG_COMPRESSED_IMAGE && !topic.ImgSpec.Passthrough {
+			// the receiver publishes the decoded video
+			return fmt.Errorf("CompressedImage topic \"" + topic.NameIn + "\" is received as video, configure it as \"" + consts.MSG_IMAGE + "\" or pass it through")
+		}
+		if topic.IsVideo() {
 			tmp := topic.ImgSpec
-			if !(tmp.Width > 0 && tmp.Height > 0 && tmp.FrameRate > 0) {
+			// zero values are discovered from the topic
+			if tmp.Width < 0 || tmp.Height < 0 || tmp.FrameRate < 0 || (tmp.Width == 0) != (tmp.Height == 0) {
 				return fmt.Errorf(fmt.Sprintf("wrong params: \"%d %d %f\"", tmp.Width, tmp.Height, tmp.FrameRate))
 			}
-		case consts.MSG_LASER_SCAN:
-			// check passed
+			switch tmp.Codec {
+			case "":
+				c.Topics[i].ImgSpec.Codec = VideoCodecVP8
+			case VideoCodecVP8, VideoCodecVP9, VideoCodecH264, VideoCodecAV1:
+			default:
+				return fmt.Errorf("wrong codec, expected \"vp8\", \"vp9\", \"h264\" or \"av1\", but find \"" + tmp.Codec + "\"")
+			}
+			if err := checkEncoder(&tmp); err != nil {
+				return err
+			}
+			if err := checkDepthMapping(&tmp); err != nil {
+				return err
+			}
+			if err := checkScaling(&tmp); err != nil {
+				return err
+			}
+		}
+		switch topic.Direction {
+		case "", DirectionToReceiver:
+		case DirectionToSender:
+			if topic.IsVideo() {
+				return fmt.Errorf("image topic \"" + topic.NameIn + "\" can't be sent to the sender")
+			}
 		default:
-			return fmt.Errorf("unsupported topic type: \"" + topic.Type + "\"")
+			return fmt.Errorf("wrong direction, expected \"to_receiver\" or \"to_sender\", but find \"" + topic.Direction + "\"")
+		}
+		switch topic.Priority {
+		case "":
+			c.Topics[i].Priority = PriorityNormal
+			if consts.HIGH_PRIORITY_MSGS[topic.Type] {
+				c.Topics[i].Priority = PriorityHigh
+			}
+		case PriorityHigh, PriorityNormal, PriorityLow:
+		default:
+			return fmt.Errorf("wrong priority, expected \"high\", \"normal\" or \"low\", but find \"" + topic.Priority + "\"")
+		}
+		if topic.MaxRateHz < 0 {
+			return fmt.Errorf("invalid max_rate_hz %f", topic.MaxRateHz)
+		}
+		if topic.KeepEveryN < 0 {
+			return fmt.Errorf("invalid keep_every_n %d", topic.KeepEveryN)
+		}
+		codec, err := compression.Parse(topic.Compression)
+		if err != nil {
+			return err
+		}
+		if codec != compression.None && topic.IsVideo() {
+			return fmt.Errorf("image topic \"" + topic.NameIn + "\" can't be compressed")
+		}
+		if codec != compression.None && topic.ImgSpec.Passthrough {
+			// JPEG and PNG images don't get any smaller
+			return fmt.Errorf("passed through topic \"" + topic.NameIn + "\" can't be compressed")
 		}
+		c.Topics[i].Compression = codec.String()
 		if !isValidQosProfile(topic.Qos) {
 			return fmt.Errorf("invalid qos profile")
 		}
@@ -158,8 +455,11 @@ func LoadCfg() *Config {
 	if _, err := os.Stat(args[1]); errors.Is(err, os.ErrNotExist) {
 		slog.Info(args[1] + " not found, using default config")
 		return &Config{
-			Mode: "sender",
-			Addr: "localhost:8080",
+			Mode:         "sender",
+			Addr:         "localhost:8080",
+			MaxReceivers: 1,
+			MinBitrate:   DefaultMinBitrate,
+			MaxBitrate:   DefaultMaxBitrate,
 			Topics: []TopicConfig{
 				{
 					NameIn:  "image",
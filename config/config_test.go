@@ -72,6 +72,11 @@ func TestCheckfunc(t *testing.T) {
 							Height:    480,
 							FrameRate: 30,
 						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
 					},
 					{
 						NameIn:  "image_raw",
@@ -82,6 +87,11 @@ func TestCheckfunc(t *testing.T) {
 							Height:    480,
 							FrameRate: 29.97,
 						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
 					},
 				},
 			},
@@ -107,6 +117,46 @@ func TestCheckfunc(t *testing.T) {
 			},
 			expected: false,
 		},
+		{
+			name: "valid config with discovered imgspec",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with negative frame rate",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Width:     640,
+							Height:    480,
+							FrameRate: -1,
+						},
+					},
+				},
+			},
+			expected: false,
+		},
 		{
 			name: "valid config",
 			cfg: &Config{
@@ -117,11 +167,833 @@ func TestCheckfunc(t *testing.T) {
 						NameIn:  "image_raw",
 						NameOut: "image",
 						Type:    "sensor_msgs/msg/LaserScan",
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "valid config with autoware type",
+			cfg: &Config{
+				Mode: "receiver",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "velocity_status",
+						NameOut: "remote/vehicle/status/velocity_status",
+						Type:    "autoware_vehicle_msgs/msg/VelocityReport",
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityReliable,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with unknown type",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "foo",
+						NameOut: "foo",
+						Type:    "foo_msgs/msg/Foo",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with dynamic type",
+			cfg: &Config{
+				Mode:         "sender",
+				Addr:         "localhost:8080",
+				DynamicTypes: true,
+				Topics: []TopicConfig{
+					{
+						NameIn:  "foo",
+						NameOut: "foo",
+						Type:    "foo_msgs/msg/Foo",
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with malformed dynamic type",
+			cfg: &Config{
+				Mode:         "sender",
+				Addr:         "localhost:8080",
+				DynamicTypes: true,
+				Topics: []TopicConfig{
+					{
+						NameIn:  "foo",
+						NameOut: "foo",
+						Type:    "foo_msgs/Foo",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with several receivers",
+			cfg: &Config{
+				Mode:         "sender",
+				Addr:         "localhost:8080",
+				MaxReceivers: 3,
+				Topics: []TopicConfig{
+					{
+						NameIn:  "scan",
+						NameOut: "scan",
+						Type:    "sensor_msgs/msg/LaserScan",
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with negative max receivers",
+			cfg: &Config{
+				Mode:         "sender",
+				Addr:         "localhost:8080",
+				MaxReceivers: -1,
+				Topics: []TopicConfig{
+					{
+						NameIn:  "scan",
+						NameOut: "scan",
+						Type:    "sensor_msgs/msg/LaserScan",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with turn server",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				ICEServers: []ICEServerConfig{
+					{
+						URLs:       []string{"turn:turn.example.com:3478?transport=udp"},
+						Username:   "user",
+						Credential: "secret",
+					},
+				},
+				ICETransportPolicy: "relay",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "scan",
+						NameOut: "scan",
+						Type:    "sensor_msgs/msg/LaserScan",
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with turn server without credential",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				ICEServers: []ICEServerConfig{
+					{
+						URLs:     []string{"turn:turn.example.com:3478"},
+						Username: "user",
+					},
+				},
+				Topics: []TopicConfig{
+					{
+						NameIn:  "scan",
+						NameOut: "scan",
+						Type:    "sensor_msgs/msg/LaserScan",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config with relay policy without turn server",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				ICEServers: []ICEServerConfig{
+					{URLs: []string{"stun:stun.example.com:3478"}},
+				},
+				ICETransportPolicy: "relay",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "scan",
+						NameOut: "scan",
+						Type:    "sensor_msgs/msg/LaserScan",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config with host only and ice servers",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				ICEServers: []ICEServerConfig{
+					{URLs: []string{"stun:stun.example.com:3478"}},
+				},
+				HostOnly: true,
+				Topics: []TopicConfig{
+					{
+						NameIn:  "scan",
+						NameOut: "scan",
+						Type:    "sensor_msgs/msg/LaserScan",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config with unknown ice server scheme",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				ICEServers: []ICEServerConfig{
+					{URLs: []string{"http://stun.example.com"}},
+				},
+				Topics: []TopicConfig{
+					{
+						NameIn:  "scan",
+						NameOut: "scan",
+						Type:    "sensor_msgs/msg/LaserScan",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid receiver config subscribing to a topic sent to the sender",
+			cfg: &Config{
+				Mode: "receiver",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:    "cmd_vel",
+						NameOut:   "cmd_vel",
+						Type:      "geometry_msgs/msg/Twist",
+						Direction: "to_sender",
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
 					},
 				},
 			},
 			expected: true,
 		},
+		{
+			name: "invalid sender config publishing a topic without qos",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:    "cmd_vel",
+						NameOut:   "cmd_vel",
+						Type:      "geometry_msgs/msg/Twist",
+						Direction: "to_sender",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config sending images to the sender",
+			cfg: &Config{
+				Mode: "receiver",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:    "image_raw",
+						NameOut:   "image",
+						Type:      "sensor_msgs/msg/Image",
+						Direction: "to_sender",
+						ImgSpec: ImageSpecifications{
+							Width:     640,
+							Height:    480,
+							FrameRate: 30,
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config with unknown direction",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:    "cmd_vel",
+						NameOut:   "cmd_vel",
+						Type:      "geometry_msgs/msg/Twist",
+						Direction: "both",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config with unknown priority",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:   "scan",
+						NameOut:  "scan",
+						Type:     "sensor_msgs/msg/LaserScan",
+						Priority: "urgent",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with compression",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:      "map",
+						NameOut:     "map",
+						Type:        "nav_msgs/msg/OccupancyGrid",
+						Compression: "zstd",
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with unknown compression",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:      "map",
+						NameOut:     "map",
+						Type:        "nav_msgs/msg/OccupancyGrid",
+						Compression: "brotli",
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config compressing images",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:      "image_raw",
+						NameOut:     "image",
+						Type:        "sensor_msgs/msg/Image",
+						Compression: "lz4",
+						ImgSpec: ImageSpecifications{
+							Width:     640,
+							Height:    480,
+							FrameRate: 30,
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with rate limit and decimation",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:     "scan",
+						NameOut:    "scan",
+						Type:       "sensor_msgs/msg/LaserScan",
+						MaxRateHz:  10,
+						KeepEveryN: 2,
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with negative max rate",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:    "scan",
+						NameOut:   "scan",
+						Type:      "sensor_msgs/msg/LaserScan",
+						MaxRateHz: -1,
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with h264 video",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Width:     640,
+							Height:    480,
+							FrameRate: 30,
+							Codec:     "h264",
+						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with unknown video codec",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Width:     640,
+							Height:    480,
+							FrameRate: 30,
+							Codec:     "mjpeg",
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with bitrate bounds",
+			cfg: &Config{
+				Mode:       "sender",
+				Addr:       "localhost:8080",
+				MinBitrate: 200_000,
+				MaxBitrate: 2_000_000,
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with min bitrate above max bitrate",
+			cfg: &Config{
+				Mode:       "sender",
+				Addr:       "localhost:8080",
+				MinBitrate: 2_000_000,
+				MaxBitrate: 1_000_000,
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with encoder params",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Width:            640,
+							Height:           480,
+							FrameRate:        30,
+							Codec:            "vp9",
+							BitRate:          1_000_000,
+							KeyFrameInterval: 30,
+							RateControl:      "cbr",
+							Deadline:         "realtime",
+							ErrorResilient:   true,
+						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with unknown rate control",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Width:       640,
+							Height:      480,
+							FrameRate:   30,
+							RateControl: "abr",
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config with vbr for h264",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Width:     640,
+							Height:    480,
+							FrameRate: 30,
+							Codec:       "h264",
+							RateControl: "vbr",
+						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config with a deadline for av1",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Width:     640,
+							Height:    480,
+							FrameRate: 30,
+							Codec:    "av1",
+							Deadline: "good",
+						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config with a preset for vp9",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Width:     640,
+							Height:    480,
+							FrameRate: 30,
+							Codec:  "vp9",
+							Preset: 8,
+						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with depth colormap",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "depth/image_raw",
+						NameOut: "depth",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Width:     640,
+							Height:    480,
+							FrameRate: 30,
+							DepthMin:  0.3,
+							DepthMax:  5,
+							Colormap:  "jet",
+						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with unknown colormap",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "depth/image_raw",
+						NameOut: "depth",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Width:     640,
+							Height:    480,
+							FrameRate: 30,
+							Colormap:  "viridis",
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with output size and crop",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							OutputWidth:   1280,
+							OutputHeight:  720,
+							Crop:          &Rect{X: 1280, Y: 720, Width: 1920, Height: 1080},
+							ScalingFilter: "area",
+						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config with output width only",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							OutputWidth: 1280,
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config with empty crop",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw",
+						NameOut: "image",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Crop: &Rect{X: 0, Y: 0, Width: 0, Height: 1080},
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "valid config with a compressed image topic",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw/compressed",
+						NameOut: "image/compressed",
+						Type:    "sensor_msgs/msg/CompressedImage",
+						ImgSpec: ImageSpecifications{
+							Codec: "h264",
+						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "valid receiver config passing a compressed image topic through",
+			cfg: &Config{
+				Mode: "receiver",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw/compressed",
+						NameOut: "image/compressed",
+						Type:    "sensor_msgs/msg/CompressedImage",
+						ImgSpec: ImageSpecifications{
+							Passthrough: true,
+						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "invalid config compressing a passed through topic",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:      "image_raw/compressed",
+						NameOut:     "image/compressed",
+						Type:        "sensor_msgs/msg/CompressedImage",
+						Compression: "zstd",
+						ImgSpec: ImageSpecifications{
+							Passthrough: true,
+						},
+						Qos: &rclgo.QosProfile{
+							History:     rclgo.HistoryKeepLast,
+							Reliability: rclgo.ReliabilityBestEffort,
+							Durability:  rclgo.DurabilityVolatile,
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid receiver config with a compressed image video",
+			cfg: &Config{
+				Mode: "receiver",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw/compressed",
+						NameOut: "image/compressed",
+						Type:    "sensor_msgs/msg/CompressedImage",
+						ImgSpec: ImageSpecifications{
+							Codec: "h264",
+						},
+					},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "invalid config passing an image topic through",
+			cfg: &Config{
+				Mode: "sender",
+				Addr: "localhost:8080",
+				Topics: []TopicConfig{
+					{
+						NameIn:  "image_raw/compressed",
+						NameOut: "image/compressed",
+						Type:    "sensor_msgs/msg/Image",
+						ImgSpec: ImageSpecifications{
+							Passthrough: true,
+						},
+					},
+				},
+			},
+			expected: false,
+		},
 		{
 			name: "invalid config",
 			cfg: &Config{
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// used when no ice_servers are configured
+var defaultICEServers = []ICEServerConfig{
+	{URLs: []string{"stun:stun.l.google.com:19302"}},
+}
+
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"` // password, or access token of "oauth" credentials
+	// either "password" (default) or "oauth"
+	CredentialType string `json:"credential_type"`
+	MACKey         string `json:"mac_key"` // only valid when credential_type is "oauth"
+}
+
+func checkICE(c *Config) error {
+	switch c.ICETransportPolicy {
+	case "", "all", "relay":
+	default:
+		return fmt.Errorf("wrong ice_transport_policy, expected \"all\" or \"relay\", but find \"%s\"", c.ICETransportPolicy)
+	}
+	if c.HostOnly {
+		if len(c.ICEServers) > 0 {
+			return fmt.Errorf("host_only can't be used with ice_servers")
+		}
+		if c.ICETransportPolicy == "relay" {
+			return fmt.Errorf("host_only can't be used with the relay ice_transport_policy")
+		}
+		return nil
+	}
+	haveTURN := false
+	for _, server := range c.ICEServers {
+		if len(server.URLs) == 0 {
+			return fmt.Errorf("ice server without urls")
+		}
+		for _, url := range server.URLs {
+			switch {
+			case strings.HasPrefix(url, "stun:"), strings.HasPrefix(url, "stuns:"):
+			case strings.HasPrefix(url, "turn:"), strings.HasPrefix(url, "turns:"):
+				haveTURN = true
+				if server.Username == "" || server.Credential == "" {
+					return fmt.Errorf("turn server \"%s\" requires a username and a credential", url)
+				}
+			default:
+				return fmt.Errorf("invalid ice server url \"%s\"", url)
+			}
+		}
+		switch server.CredentialType {
+		case "", "password":
+		case "oauth":
+			if server.MACKey == "" {
+				return fmt.Errorf("oauth credential of \"%s\" requires a mac_key", server.URLs[0])
+			}
+		default:
+			return fmt.Errorf("wrong credential_type, expected \"password\" or \"oauth\", but find \"%s\"", server.CredentialType)
+		}
+	}
+	if c.ICETransportPolicy == "relay" && !haveTURN {
+		return fmt.Errorf("the relay ice_transport_policy requires a turn server")
+	}
+	return nil
+}
+
+// RTCConfiguration returns the peer connection configuration for the ICE
+// settings of the config.
+func (c *Config) RTCConfiguration() webrtc.Configuration {
+	rtcConfig := webrtc.Configuration{
+		ICETransportPolicy: webrtc.ICETransportPolicyAll,
+	}
+	if c.ICETransportPolicy == "relay" {
+		rtcConfig.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	if c.HostOnly {
+		// without servers only host candidates are gathered
+		return rtcConfig
+	}
+	servers := c.ICEServers
+	if servers == nil {
+		servers = defaultICEServers
+	}
+	for _, server := range servers {
+		iceServer := webrtc.ICEServer{
+			URLs:           server.URLs,
+			Username:       server.Username,
+			Credential:     server.Credential,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		}
+		if server.CredentialType == "oauth" {
+			iceServer.CredentialType = webrtc.ICECredentialTypeOauth
+			iceServer.Credential = webrtc.OAuthCredential{
+				MACKey:      server.MACKey,
+				AccessToken: server.Credential,
+			}
+		}
+		rtcConfig.ICEServers = append(rtcConfig.ICEServers, iceServer)
+	}
+	return rtcConfig
+}
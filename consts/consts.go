@@ -1,8 +1,9 @@
 package consts
 
 const (
-	MSG_IMAGE      = "sensor_msgs/msg/Image"
-	MSG_LASER_SCAN = "sensor_msgs/msg/LaserScan"
+	MSG_IMAGE            = "sensor_msgs/msg/Image"
+	MSG_COMPRESSED_IMAGE = "sensor_msgs/msg/CompressedImage"
+	MSG_LASER_SCAN       = "sensor_msgs/msg/LaserScan"
 
 	// 高优先级消息类型
 	MSG_CONTROL_CMD  = "autoware_control_msgs/msg/Control"
@@ -14,3 +15,15 @@ const (
 	MSG_KINEMATIC    = "nav_msgs/msg/Odometry"
 	MSG_POSE_COV     = "geometry_msgs/msg/PoseWithCovarianceStamped"
 )
+
+// 默认以高优先级发送的消息类型
+var HIGH_PRIORITY_MSGS = map[string]bool{
+	MSG_CONTROL_CMD:  true,
+	MSG_TRAJECTORY:   true,
+	MSG_CONTROL_MODE: true,
+	MSG_VELOCITY:     true,
+	MSG_STEERING:     true,
+	MSG_GEAR:         true,
+	MSG_KINEMATIC:    true,
+	MSG_POSE_COV:     true,
+}
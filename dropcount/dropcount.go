@@ -0,0 +1,48 @@
+// Package dropcount counts the messages dropped on a topic and paces the logs
+// reporting them, so that a topic dropping every message doesn't flood the
+// log.
+package dropcount
+
+import "time"
+
+// ReportInterval is the minimum time between two reports of a Counter.
+const ReportInterval = 10 * time.Second
+
+// Counter counts the messages dropped on a topic. It isn't safe for
+// concurrent use, its owner guards it with the lock of what it counts for.
+type Counter struct {
+	total      uint64
+	pending    uint64 // dropped since the last report
+	lastReport time.Time
+}
+
+// Drop counts a message dropped at now. It returns the number of messages
+// to report, dropped since the last report, when a report is due: on the
+// first drop, then at most every ReportInterval. Otherwise it returns 0.
+func (c *Counter) Drop(now time.Time) uint64 {
+	c.total++
+	c.pending++
+	if now.Sub(c.lastReport) < ReportInterval {
+		return 0
+	}
+	return c.Flush(now)
+}
+
+// Flush returns the number of messages dropped since the last report,
+// reporting them at now, e.g. once the consumer caught up.
+func (c *Counter) Flush(now time.Time) uint64 {
+	pending := c.pending
+	c.pending = 0
+	c.lastReport = now
+	return pending
+}
+
+// Pending returns the number of messages dropped since the last report.
+func (c *Counter) Pending() uint64 {
+	return c.pending
+}
+
+// Total returns the number of messages dropped so far.
+func (c *Counter) Total() uint64 {
+	return c.total
+}
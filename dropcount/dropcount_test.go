@@ -0,0 +1,29 @@
+package dropcount
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounter(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := Counter{}
+	if n := c.Drop(now); n != 1 {
+		t.Errorf("expected the first drop reported right away, got %d", n)
+	}
+	for i := 0; i < 3; i++ {
+		if n := c.Drop(now.Add(time.Second)); n != 0 {
+			t.Errorf("expected no report within the interval, got %d", n)
+		}
+	}
+	if n := c.Drop(now.Add(ReportInterval)); n != 4 {
+		t.Errorf("expected the 4 drops since the last report, got %d", n)
+	}
+	c.Drop(now.Add(ReportInterval + time.Second))
+	if c.Pending() != 1 || c.Flush(now.Add(ReportInterval+2*time.Second)) != 1 || c.Pending() != 0 {
+		t.Error("expected Flush to report the pending drop")
+	}
+	if c.Total() != 6 {
+		t.Errorf("expected 6 drops in total, got %d", c.Total())
+	}
+}
@@ -0,0 +1,162 @@
+package envelope
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/3DRX/webrtc-ros-bridge/compression"
+)
+
+// Version is the envelope wire format version written by Marshal. Version 1
+// reserved the flags, version 2 uses them for fragments and compression.
+// Version 1 envelopes, whose flags are zero, are still read.
+const Version uint8 = 2
+
+// headerSize is the size of the fixed part of the header:
+// version(1) flags(1) seq(8) timestamp(8) topic length(2) type length(2)
+const headerSize = 22
+
+// FlagFragment marks an envelope carrying one fragment of a message, see
+// MarshalFragments.
+const FlagFragment uint8 = 1 << 0
+
+// compressionShift and compressionMask locate the compression.Codec of the
+// payload in the flags.
+const (
+	compressionShift       = 1
+	compressionMask  uint8 = 0b11 << compressionShift
+)
+
+// fragmentHeaderSize is the size of the fragment index and count following
+// the timestamp of fragments.
+const fragmentHeaderSize = 4
+
+var (
+	ErrShortBuffer         = errors.New("envelope: buffer too short")
+	ErrUnsupportedVersion  = errors.New("envelope: unsupported version")
+	ErrCompressionMismatch = errors.New("envelope: compression mismatch")
+)
+
+// Envelope wraps a serialized ROS message sent over a data channel, so that
+// the receiver knows which topic and message type the payload belongs to.
+//
+// Wire format (big endian):
+//
+//	| version u8 | flags u8 | seq u64 | timestamp i64 (unix ns) |
+//	| fragment index u16 | fragment count u16 | (only with FlagFragment)
+//	| topic len u16 | topic | type len u16 | type | payload ... |
+type Envelope struct {
+	Topic     string    // name_out of the topic on the sender side
+	Type      string    // ROS message type, e.g. "sensor_msgs/msg/LaserScan"
+	Seq       uint64    // per topic sequence number
+	Timestamp time.Time // time the sender wrapped the message
+	Flags     uint8     // bit set of Flag* values and the compression codec
+	FragIndex uint16    // index of the fragment, only with FlagFragment
+	FragCount uint16    // fragments of the message, only with FlagFragment
+	Payload   []byte    // serialized ROS message, or a fragment of it
+}
+
+func (e *Envelope) Marshal() ([]byte, error) {
+	if len(e.Topic) > math.MaxUint16 || len(e.Type) > math.MaxUint16 {
+		return nil, errors.New("envelope: topic or type name too long")
+	}
+	buf := make([]byte, 0, e.headerLen()+len(e.Payload))
+	buf = append(buf, Version, e.Flags)
+	buf = binary.BigEndian.AppendUint64(buf, e.Seq)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.Timestamp.UnixNano()))
+	if e.Flags&FlagFragment != 0 {
+		buf = binary.BigEndian.AppendUint16(buf, e.FragIndex)
+		buf = binary.BigEndian.AppendUint16(buf, e.FragCount)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(e.Topic)))
+	buf = append(buf, e.Topic...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(e.Type)))
+	buf = append(buf, e.Type...)
+	buf = append(buf, e.Payload...)
+	return buf, nil
+}
+
+// Unmarshal parses data into an Envelope. The returned Payload aliases data.
+func Unmarshal(data []byte) (*Envelope, error) {
+	if len(data) < headerSize {
+		return nil, ErrShortBuffer
+	}
+	switch data[0] {
+	case Version:
+	case 1:
+		if data[1] != 0 {
+			return nil, fmt.Errorf("%w: 1 with flags %#x", ErrUnsupportedVersion, data[1])
+		}
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[0])
+	}
+	e := &Envelope{
+		Flags:     data[1],
+		Seq:       binary.BigEndian.Uint64(data[2:10]),
+		Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(data[10:18]))),
+	}
+	rest := data[18:]
+	if e.Flags&FlagFragment != 0 {
+		if len(rest) < fragmentHeaderSize {
+			return nil, ErrShortBuffer
+		}
+		e.FragIndex = binary.BigEndian.Uint16(rest[0:2])
+		e.FragCount = binary.BigEndian.Uint16(rest[2:4])
+		rest = rest[fragmentHeaderSize:]
+	}
+	topic, rest, err := readString(rest)
+	if err != nil {
+		return nil, err
+	}
+	typ, rest, err := readString(rest)
+	if err != nil {
+		return nil, err
+	}
+	e.Topic = topic
+	e.Type = typ
+	e.Payload = rest
+	return e, nil
+}
+
+// Compression returns the codec the payload was compressed with.
+func (e *Envelope) Compression() compression.Codec {
+	return compression.Codec((e.Flags & compressionMask) >> compressionShift)
+}
+
+func (e *Envelope) SetCompression(c compression.Codec) {
+	e.Flags = e.Flags&^compressionMask | uint8(c)<<compressionShift&compressionMask
+}
+
+// DecompressPayload returns the decompressed payload, failing when it was
+// compressed with another codec than expected, that is when the bridges are
+// configured with a different compression for the topic.
+func (e *Envelope) DecompressPayload(expected compression.Codec) ([]byte, error) {
+	if c := e.Compression(); c != expected {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrCompressionMismatch, expected, c)
+	}
+	return expected.Decompress(e.Payload)
+}
+
+// headerLen is the marshaled size of everything but the payload.
+func (e *Envelope) headerLen() int {
+	n := headerSize + len(e.Topic) + len(e.Type)
+	if e.Flags&FlagFragment != 0 {
+		n += fragmentHeaderSize
+	}
+	return n
+}
+
+func readString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, ErrShortBuffer
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < n {
+		return "", nil, ErrShortBuffer
+	}
+	return string(data[:n]), data[n:], nil
+}
@@ -0,0 +1,216 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/3DRX/webrtc-ros-bridge/compression"
+)
+
+func TestMarshalUnmarshal(t *testing.T) {
+	e := &Envelope{
+		Topic:     "velocity_status",
+		Type:      "autoware_vehicle_msgs/msg/VelocityReport",
+		Seq:       42,
+		Timestamp: time.Unix(1700000000, 123456789),
+		Payload:   []byte{0, 1, 0, 0, 1, 2, 3, 4},
+	}
+	data, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Topic != e.Topic || got.Type != e.Type || got.Seq != e.Seq ||
+		!got.Timestamp.Equal(e.Timestamp) || !bytes.Equal(got.Payload, e.Payload) {
+		t.Errorf("round trip mismatch: expected %+v, got %+v", e, got)
+	}
+
+	// version 1 envelopes without flags are still read
+	data[0] = 1
+	if got, err := Unmarshal(data); err != nil || !bytes.Equal(got.Payload, e.Payload) {
+		t.Errorf("failed to read a version 1 envelope: %v", err)
+	}
+}
+
+func TestCompressionFlag(t *testing.T) {
+	e := &Envelope{Topic: "map", Type: "nav_msgs/msg/OccupancyGrid", Payload: make([]byte, 3000)}
+	e.SetCompression(compression.Zstd)
+	messages, err := e.MarshalFragments(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReassembler(time.Second, nil)
+	var got *Envelope
+	for _, message := range messages {
+		fragment, err := Unmarshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fragment.Compression() != compression.Zstd {
+			t.Errorf("expected zstd on every fragment, got %s", fragment.Compression())
+		}
+		if got, err = r.Add(fragment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got == nil {
+		t.Fatal("message incomplete after all fragments")
+	}
+	if got.Compression() != compression.Zstd || got.Flags&FlagFragment != 0 {
+		t.Errorf("expected an unfragmented zstd message, got flags %08b", got.Flags)
+	}
+	got.SetCompression(compression.None)
+	if got.Flags != 0 {
+		t.Errorf("expected no flags, got %08b", got.Flags)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	e := &Envelope{Topic: "scan", Type: "sensor_msgs/msg/LaserScan", Payload: []byte{1, 2}}
+	data, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		data     []byte
+		expected error
+	}{
+		{
+			name:     "empty",
+			data:     nil,
+			expected: ErrShortBuffer,
+		},
+		{
+			name:     "truncated type",
+			data:     data[:headerSize+len(e.Topic)+3],
+			expected: ErrShortBuffer,
+		},
+		{
+			name:     "unknown version",
+			data:     append([]byte{Version + 1}, data[1:]...),
+			expected: ErrUnsupportedVersion,
+		},
+		{
+			name:     "version 1 with flags",
+			data:     append([]byte{1, FlagFragment}, data[2:]...),
+			expected: ErrUnsupportedVersion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Unmarshal(tt.data)
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("expected error %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestFragments(t *testing.T) {
+	payload := make([]byte, 10000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	e := &Envelope{
+		Topic:     "map",
+		Type:      "nav_msgs/msg/OccupancyGrid",
+		Seq:       7,
+		Timestamp: time.Unix(1700000000, 0),
+		Payload:   payload,
+	}
+	const maxSize = 1024
+	messages, err := e.MarshalFragments(maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) < 2 {
+		t.Fatalf("expected several fragments, got %d", len(messages))
+	}
+	r := NewReassembler(time.Second, nil)
+	// fragments may arrive out of order on unordered data channels
+	for i := len(messages) - 1; i >= 0; i-- {
+		if len(messages[i]) > maxSize {
+			t.Fatalf("fragment %d has %d bytes, more than %d", i, len(messages[i]), maxSize)
+		}
+		fragment, err := Unmarshal(messages[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.Add(fragment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			if got != nil {
+				t.Fatalf("message complete after %d fragments", len(messages)-i)
+			}
+			continue
+		}
+		if got == nil {
+			t.Fatal("message incomplete after all fragments")
+		}
+		if got.Topic != e.Topic || got.Type != e.Type || got.Seq != e.Seq ||
+			got.Flags != 0 || !bytes.Equal(got.Payload, e.Payload) {
+			t.Errorf("reassembled message mismatch: expected %+v, got %+v", e, got)
+		}
+	}
+
+	small := &Envelope{Topic: "scan", Type: "sensor_msgs/msg/LaserScan", Payload: []byte{1, 2, 3}}
+	messages, err = small.MarshalFragments(maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected a single message, got %d", len(messages))
+	}
+}
+
+func TestReassemblerDiscardsIncomplete(t *testing.T) {
+	e := &Envelope{Topic: "map", Type: "nav_msgs/msg/OccupancyGrid", Seq: 1, Payload: make([]byte, 4096)}
+	messages, err := e.MarshalFragments(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	discarded := 0
+	r := NewReassembler(time.Second, func(topic string, seq uint64) { discarded++ })
+	r.now = func() time.Time { return now }
+	fragment, err := Unmarshal(messages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(fragment); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Second)
+	if _, err := r.Add(&Envelope{Topic: "scan"}); err != nil {
+		t.Fatal(err)
+	}
+	if discarded != 1 || r.Pending() != 0 {
+		t.Errorf("expected the incomplete message to be discarded, %d discarded and %d pending", discarded, r.Pending())
+	}
+
+	// without further fragments, Expire discards it
+	if _, err := r.Add(fragment); err != nil {
+		t.Fatal(err)
+	}
+	r.Expire(now.Add(500 * time.Millisecond))
+	if discarded != 1 || r.Pending() != 1 {
+		t.Errorf("expected the message to wait for its fragments, %d discarded and %d pending", discarded, r.Pending())
+	}
+	r.Expire(now.Add(2 * time.Second))
+	if discarded != 2 || r.Pending() != 0 {
+		t.Errorf("expected Expire to discard the incomplete message, %d discarded and %d pending", discarded, r.Pending())
+	}
+
+	invalid := &Envelope{Topic: "map", Flags: FlagFragment, FragIndex: 2, FragCount: 2}
+	if _, err := r.Add(invalid); !errors.Is(err, ErrInvalidFragment) {
+		t.Errorf("expected ErrInvalidFragment, got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package envelope
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// MaxMessageSize is the largest data channel message the bridge sends,
+// larger messages are fragmented.
+const MaxMessageSize = 16 * 1024
+
+var ErrInvalidFragment = errors.New("envelope: invalid fragment")
+
+// MarshalFragments marshals e into data channel messages of at most maxSize
+// bytes. A message that fits is marshaled as is, a larger one is split into
+// fragments sharing its Seq, to be put back together by a Reassembler.
+func (e *Envelope) MarshalFragments(maxSize int) ([][]byte, error) {
+	if e.headerLen()+len(e.Payload) <= maxSize {
+		data, err := e.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{data}, nil
+	}
+	fragment := *e
+	fragment.Flags |= FlagFragment
+	chunkSize := maxSize - fragment.headerLen()
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("envelope: message size %d too small for the header", maxSize)
+	}
+	count := (len(e.Payload) + chunkSize - 1) / chunkSize
+	if count > math.MaxUint16 {
+		return nil, fmt.Errorf("envelope: message of %d bytes too large", len(e.Payload))
+	}
+	fragment.FragCount = uint16(count)
+	messages := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		fragment.FragIndex = uint16(i)
+		fragment.Payload = e.Payload[i*chunkSize : min((i+1)*chunkSize, len(e.Payload))]
+		data, err := fragment.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, data)
+	}
+	return messages, nil
+}
+
+type fragmentKey struct {
+	topic string
+	seq   uint64
+}
+
+type partialMessage struct {
+	envelope  Envelope
+	fragments [][]byte
+	received  int
+	firstSeen time.Time
+}
+
+// Reassembler puts fragmented messages back together. Messages missing
+// fragments for longer than the timeout are discarded, calling onDiscard
+// if set, by the next Add or Expire call.
+type Reassembler struct {
+	mu        sync.Mutex
+	timeout   time.Duration
+	onDiscard func(topic string, seq uint64)
+	partial   map[fragmentKey]*partialMessage
+	now       func() time.Time
+}
+
+func NewReassembler(timeout time.Duration, onDiscard func(topic string, seq uint64)) *Reassembler {
+	return &Reassembler{
+		timeout:   timeout,
+		onDiscard: onDiscard,
+		partial:   make(map[fragmentKey]*partialMessage),
+		now:       time.Now,
+	}
+}
+
+// Add takes an unmarshaled envelope and returns the complete message it
+// belongs to, or nil while fragments of the message are missing.
+func (r *Reassembler) Add(e *Envelope) (*Envelope, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.discardExpired(now)
+	if e.Flags&FlagFragment == 0 {
+		return e, nil
+	}
+	if e.FragCount == 0 || e.FragIndex >= e.FragCount {
+		return nil, fmt.Errorf("%w: index %d of %d", ErrInvalidFragment, e.FragIndex, e.FragCount)
+	}
+	key := fragmentKey{topic: e.Topic, seq: e.Seq}
+	p, ok := r.partial[key]
+	if !ok {
+		p = &partialMessage{
+			envelope:  *e,
+			fragments: make([][]byte, e.FragCount),
+			firstSeen: now,
+		}
+		r.partial[key] = p
+	}
+	if len(p.fragments) != int(e.FragCount) {
+		delete(r.partial, key)
+		return nil, fmt.Errorf("%w: fragment count changed from %d to %d", ErrInvalidFragment, len(p.fragments), e.FragCount)
+	}
+	if p.fragments[e.FragIndex] != nil {
+		return nil, nil // duplicate
+	}
+	// the payload may alias a buffer reused by the caller
+	p.fragments[e.FragIndex] = append([]byte{}, e.Payload...)
+	p.received++
+	if p.received < len(p.fragments) {
+		return nil, nil
+	}
+	delete(r.partial, key)
+	size := 0
+	for _, f := range p.fragments {
+		size += len(f)
+	}
+	payload := make([]byte, 0, size)
+	for _, f := range p.fragments {
+		payload = append(payload, f...)
+	}
+	complete := p.envelope
+	complete.Flags &^= FlagFragment
+	complete.FragIndex = 0
+	complete.FragCount = 0
+	complete.Payload = payload
+	return &complete, nil
+}
+
+// Pending returns the number of messages waiting for fragments.
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.partial)
+}
+
+// Expire discards the messages missing fragments for longer than the
+// timeout at now. Call it periodically, so that the fragments of a topic
+// that stopped sending don't stay around.
+func (r *Reassembler) Expire(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.discardExpired(now)
+}
+
+func (r *Reassembler) discardExpired(now time.Time) {
+	for key, p := range r.partial {
+		if now.Sub(p.firstSeen) > r.timeout {
+			delete(r.partial, key)
+			if r.onDiscard != nil {
+				r.onDiscard(key.topic, key.seq)
+			}
+		}
+	}
+}
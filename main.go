@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"log/slog"
+	"time"
+
 	"github.com/3DRX/webrtc-ros-bridge/config"
 	recv_peerconnectionchannel "github.com/3DRX/webrtc-ros-bridge/receiver/peer_connection_channel"
 	recv_roschannel "github.com/3DRX/webrtc-ros-bridge/receiver/ros_channel"
@@ -9,72 +13,173 @@ import (
 	send_roschannel "github.com/3DRX/webrtc-ros-bridge/sender/ros_channel"
 	send_signalingchannel "github.com/3DRX/webrtc-ros-bridge/sender/signaling_channel"
 	"github.com/pion/webrtc/v4"
-	"github.com/tiiuae/rclgo/pkg/rclgo/types"
+)
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
 )
 
 func receiver(cfg *config.Config) {
-	messageChan := make(chan types.Message)
+	messageChan := make(chan recv_roschannel.TopicMessage)
+	outgoing := recv_roschannel.NewOutgoing()
+	roiChan := make(chan recv_roschannel.ROIRequest)
+	rc := recv_roschannel.InitROSChannel(
+		cfg,
+		messageChan,
+		outgoing,
+		roiChan,
+	)
+	go rc.Spin()
+	delay := minReconnectDelay
+	for {
+		if receiverSession(cfg, messageChan, outgoing, roiChan) {
+			// the session was up, retry right away
+			delay = minReconnectDelay
+		} else {
+			delay = min(delay*2, maxReconnectDelay)
+		}
+		slog.Info("reconnecting to sender", "delay", delay)
+		time.Sleep(delay)
+	}
+}
+
+// receiverSession connects to the sender and bridges its streams until the
+// websocket closes or the peer connection fails. It reports whether the
+// sender could be reached.
+func receiverSession(
+	cfg *config.Config,
+	messageChan chan<- recv_roschannel.TopicMessage,
+	outgoing *recv_roschannel.Outgoing,
+	roiChan <-chan recv_roschannel.ROIRequest,
+) bool {
 	sdpChan := make(chan webrtc.SessionDescription)
 	sdpReplyChan := make(chan webrtc.SessionDescription)
 	candidateChan := make(chan webrtc.ICECandidateInit)
-	topicIdx := 0 // TODO: refactor similar to sender
 	sc := recv_signalingchannel.InitSignalingChannel(
 		cfg,
-		topicIdx,
 		sdpChan,
 		sdpReplyChan,
 		candidateChan,
 	)
+	if err := sc.Connect(); err != nil {
+		slog.Error("failed to connect to sender", "error", err)
+		return false
+	}
 	pc := recv_peerconnectionchannel.InitPeerConnectionChannel(
+		cfg,
 		sdpChan,
 		sdpReplyChan,
 		candidateChan,
 		sc.SignalCandidate,
+		sc.TopicOfTrack,
 		messageChan,
+		outgoing.Open(),
 	)
-	rc := recv_roschannel.InitROSChannel(
-		cfg,
-		topicIdx,
-		messageChan,
-	)
+	defer outgoing.Close()
 	go sc.Spin()
 	go pc.Spin()
-	go rc.Spin()
-	select {}
+	go func() {
+		for {
+			select {
+			case request := <-roiChan:
+				if err := sc.RequestROI(request.Topic, request.Crop); err != nil {
+					slog.Error("failed to send ROI request", "topic", request.Topic, "error", err)
+				}
+			case <-sc.Done():
+				return
+			}
+		}
+	}()
+	select {
+	case <-sc.Done():
+		slog.Info("signaling session ended, closing peer connection")
+	case <-pc.Done():
+		slog.Info("peer connection lost, closing signaling session")
+	}
+	pc.Close()
+	sc.Close()
+	return true
 }
 
 func sender(cfg *config.Config) {
-	messageChan := make(chan types.Message)
-	sendSDPChan := make(chan webrtc.SessionDescription)
-	recvSDPChan := make(chan webrtc.SessionDescription)
-	sendCandidateChan := make(chan webrtc.ICECandidateInit)
-	recvCandidateChan := make(chan webrtc.ICECandidateInit)
-	sc := send_signalingchannel.InitSignalingChannel(
-		cfg,
-		sendSDPChan,
-		recvSDPChan,
-		sendCandidateChan,
-		recvCandidateChan,
-	)
-	haveReceiverPromise := sc.Spin()
-	<-haveReceiverPromise
-	actions := sc.GetActions()
+	mailboxes := send_roschannel.NewMailboxes()
+	sc := send_signalingchannel.InitSignalingChannel(cfg)
 	rc := send_roschannel.InitROSChannel(
 		cfg,
-		messageChan,
+		mailboxes,
 	)
 	go rc.Spin()
-	pc := send_peerconnectionchannel.InitPeerConnectionChannel(
-		messageChan,
-		sendSDPChan,
-		recvSDPChan,
-		sendCandidateChan,
-		recvCandidateChan,
-		actions,
-		&(cfg.Topics[0].ImgSpec),
+	hub := send_peerconnectionchannel.InitHub(cfg, mailboxes)
+	go hub.Spin()
+	receivers := sc.Spin()
+	for receiver := range receivers {
+		go senderSession(cfg, receiver, rc, hub)
+	}
+}
+
+// senderSession streams to a receiver until its websocket closes or its
+// peer connection fails, then releases everything the session held.
+func senderSession(
+	cfg *config.Config,
+	receiver *send_signalingchannel.Receiver,
+	rc *send_roschannel.ROSChannel,
+	hub *send_peerconnectionchannel.Hub,
+) {
+	videoTracks := receiver.GetVideoTracks()
+	// only subscribe to the image topics the receiver asked for
+	for _, track := range videoTracks {
+		if err := rc.SubscribeOnDemand(track.Topic); err != nil {
+			// the subscriptions taken so far are released by the deferred calls
+			slog.Error("failed to subscribe to image topic", "topic", track.Topic.NameIn, "error", err)
+			receiver.SendError(fmt.Errorf("failed to subscribe to \"%s\": %w", track.Topic.NameIn, err))
+			receiver.Close()
+			return
+		}
+		defer rc.Unsubscribe(track.Topic)
+	}
+	pc, err := send_peerconnectionchannel.InitPeerConnectionChannel(
+		hub,
+		rc.Publish,
+		receiver.SendSDPChan(),
+		receiver.RecvSDPChan(),
+		receiver.SendCandidateChan(),
+		receiver.RecvCandidateChan(),
+		videoTracks,
+		cfg,
 	)
-	go pc.Spin()
-	select {}
+	if err != nil {
+		slog.Error("failed to create peer connection", "error", err)
+		receiver.SendError(fmt.Errorf("failed to create peer connection: %w", err))
+		receiver.Close()
+		return
+	}
+	go func() {
+		if err := pc.Spin(); err != nil {
+			// closing the peer connection ends the session below
+			slog.Error("failed to negotiate peer connection", "error", err)
+			receiver.SendError(err)
+			pc.Close()
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case request := <-receiver.RecvROIChan():
+				hub.SetCrop(request.Topic, request.Crop)
+			case <-receiver.Done():
+				return
+			}
+		}
+	}()
+	select {
+	case <-receiver.Done():
+		slog.Info("receiver left, closing peer connection")
+	case <-pc.Done():
+		slog.Info("peer connection lost, closing signaling session")
+	}
+	pc.Close()
+	receiver.Close()
 }
 
 func main() {
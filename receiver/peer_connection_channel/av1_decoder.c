@@ -0,0 +1,76 @@
+//go:build av1
+
+// av1_decoder.c
+#include "av1_decoder.h"
+#include "yuv_image.h"
+#include <dav1d/dav1d.h>
+#include <errno.h>
+#include <stdlib.h>
+#include <string.h>
+
+struct av1_decoder {
+  Dav1dContext *ctx;
+};
+
+av1_decoder *av1_decoder_create(void) {
+  av1_decoder *dec = calloc(1, sizeof(av1_decoder));
+  if (dec == NULL) {
+    return NULL;
+  }
+  Dav1dSettings settings;
+  dav1d_default_settings(&settings);
+  // output every frame as soon as it is decoded
+  settings.max_frame_delay = 1;
+  if (dav1d_open(&dec->ctx, &settings) < 0) {
+    free(dec);
+    return NULL;
+  }
+  return dec;
+}
+
+int av1_decode_frame(av1_decoder *dec, const uint8_t *data, size_t data_size,
+                     sensor_msgs__msg__Image *ros_img) {
+  Dav1dData in;
+  memset(&in, 0, sizeof(in));
+  uint8_t *buf = dav1d_data_create(&in, data_size);
+  if (buf == NULL) {
+    return DAV1D_ERR(ENOMEM);
+  }
+  memcpy(buf, data, data_size);
+  int ret = dav1d_send_data(dec->ctx, &in);
+  if (ret < 0 && ret != DAV1D_ERR(EAGAIN)) {
+    dav1d_data_unref(&in);
+    return ret;
+  }
+  Dav1dPicture pic;
+  memset(&pic, 0, sizeof(pic));
+  int got = dav1d_get_picture(dec->ctx, &pic);
+  if (in.sz > 0) {
+    // the decoder was full, hand it the rest now that a picture is out
+    if (dav1d_send_data(dec->ctx, &in) < 0) {
+      dav1d_data_unref(&in);
+    }
+  }
+  if (got == DAV1D_ERR(EAGAIN)) {
+    return 0;
+  }
+  if (got < 0) {
+    return got;
+  }
+  if (pic.p.layout != DAV1D_PIXEL_LAYOUT_I420 || pic.p.bpc != 8) {
+    dav1d_picture_unref(&pic);
+    return DAV1D_ERR(ENOTSUP);
+  }
+  uint8_t *const planes[3] = {pic.data[0], pic.data[1], pic.data[2]};
+  // the chroma planes share a stride
+  const int strides[3] = {(int)pic.stride[0], (int)pic.stride[1],
+                          (int)pic.stride[1]};
+  yuv420_to_ros_image(planes, strides, pic.p.w, pic.p.h, ros_img);
+  dav1d_picture_unref(&pic);
+  return 1;
+}
+
+void av1_decoder_destroy(av1_decoder *dec) {
+  dav1d_close(&dec->ctx);
+  free(dec);
+}
@@ -0,0 +1,17 @@
+#ifndef AV1_DECODER_H_
+#define AV1_DECODER_H_
+
+#include <sensor_msgs/msg/image.h>
+#include <stddef.h>
+#include <stdint.h>
+
+typedef struct av1_decoder av1_decoder;
+
+av1_decoder *av1_decoder_create(void);
+// Returns 1 when a frame was decoded into ros_img, 0 when the decoder needs
+// more data and a negative dav1d error on error.
+int av1_decode_frame(av1_decoder *dec, const uint8_t *data, size_t data_size,
+                     sensor_msgs__msg__Image *ros_img);
+void av1_decoder_destroy(av1_decoder *dec);
+
+#endif // AV1_DECODER_H_
@@ -0,0 +1,67 @@
+//go:build h264
+
+// h264_decoder.c
+#include "h264_decoder.h"
+#include "yuv_image.h"
+#include <stdlib.h>
+#include <string.h>
+#include <wels/codec_api.h>
+
+// States the decoder recovers from once the next IDR frame arrives, e.g. for
+// the frames received before the first one, which need more data rather than
+// being errors
+#define H264_RECOVERABLE_STATES                                                \
+  (dsFramePending | dsRefLost | dsDepLayerLost | dsNoParamSets |               \
+   dsDataErrorConcealed)
+
+struct h264_decoder {
+  ISVCDecoder *decoder;
+};
+
+h264_decoder *h264_decoder_create(void) {
+  h264_decoder *dec = calloc(1, sizeof(h264_decoder));
+  if (dec == NULL) {
+    return NULL;
+  }
+  if (WelsCreateDecoder(&dec->decoder) != 0) {
+    free(dec);
+    return NULL;
+  }
+  SDecodingParam param;
+  memset(&param, 0, sizeof(param));
+  param.sVideoProperty.eVideoBsType = VIDEO_BITSTREAM_AVC;
+  if ((*dec->decoder)->Initialize(dec->decoder, &param) != 0) {
+    WelsDestroyDecoder(dec->decoder);
+    free(dec);
+    return NULL;
+  }
+  return dec;
+}
+
+int h264_decode_frame(h264_decoder *dec, const uint8_t *data, size_t data_size,
+                      sensor_msgs__msg__Image *ros_img) {
+  uint8_t *planes[3] = {NULL, NULL, NULL};
+  SBufferInfo info;
+  memset(&info, 0, sizeof(info));
+  DECODING_STATE state = (*dec->decoder)->DecodeFrameNoDelay(
+      dec->decoder, data, (int)data_size, planes, &info);
+  if (state & ~H264_RECOVERABLE_STATES) {
+    return -(int)state;
+  }
+  if (info.iBufferStatus != 1) {
+    return 0;
+  }
+  // the chroma planes share a stride
+  const int strides[3] = {info.UsrData.sSystemBuffer.iStride[0],
+                          info.UsrData.sSystemBuffer.iStride[1],
+                          info.UsrData.sSystemBuffer.iStride[1]};
+  yuv420_to_ros_image(planes, strides, info.UsrData.sSystemBuffer.iWidth,
+                      info.UsrData.sSystemBuffer.iHeight, ros_img);
+  return 1;
+}
+
+void h264_decoder_destroy(h264_decoder *dec) {
+  (*dec->decoder)->Uninitialize(dec->decoder);
+  WelsDestroyDecoder(dec->decoder);
+  free(dec);
+}
@@ -0,0 +1,17 @@
+#ifndef H264_DECODER_H_
+#define H264_DECODER_H_
+
+#include <sensor_msgs/msg/image.h>
+#include <stddef.h>
+#include <stdint.h>
+
+typedef struct h264_decoder h264_decoder;
+
+h264_decoder *h264_decoder_create(void);
+// Returns 1 when a frame was decoded into ros_img, 0 when the decoder needs
+// more data and a negative openh264 decoding state on error.
+int h264_decode_frame(h264_decoder *dec, const uint8_t *data, size_t data_size,
+                      sensor_msgs__msg__Image *ros_img);
+void h264_decoder_destroy(h264_decoder *dec);
+
+#endif // H264_DECODER_H_
@@ -3,23 +3,37 @@ package peerconnectionchannel
 import (
 	"fmt"
 	"log/slog"
+	"sync"
 	"time"
 
-	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+	"github.com/3DRX/webrtc-ros-bridge/compression"
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/3DRX/webrtc-ros-bridge/consts"
+	"github.com/3DRX/webrtc-ros-bridge/envelope"
+	recv_roschannel "github.com/3DRX/webrtc-ros-bridge/receiver/ros_channel"
 	"github.com/pion/interceptor"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 	"github.com/tiiuae/rclgo/pkg/rclgo"
-	"github.com/tiiuae/rclgo/pkg/rclgo/types"
 )
 
+// how long fragments of a message are kept waiting for the missing ones
+const reassemblyTimeout = 5 * time.Second
+
 type PeerConnectionChannel struct {
+	cfg             *config.Config
 	sdpChan         <-chan webrtc.SessionDescription
 	sdpReplyChan    chan<- webrtc.SessionDescription
 	candidateChan   <-chan webrtc.ICECandidateInit
 	peerConnection  *webrtc.PeerConnection
 	signalCandidate func(c webrtc.ICECandidateInit) error
-	messageChan     chan<- types.Message
+	topicOfTrack    func(trackId string) (string, bool)
+	messageChan     chan<- recv_roschannel.TopicMessage
+	outgoingChan    <-chan recv_roschannel.TopicMessage
+	dataChannelsMu  sync.Mutex
+	dataChannels    map[string]*webrtc.DataChannel // label -> open data channel
+	done            chan struct{}
+	closeOnce       sync.Once
 }
 
 func registerHeaderExtensionURI(m *webrtc.MediaEngine, uris []string) {
@@ -38,19 +52,52 @@ func registerHeaderExtensionURI(m *webrtc.MediaEngine, uris []string) {
 }
 
 func InitPeerConnectionChannel(
+	cfg *config.Config,
 	sdpChan chan webrtc.SessionDescription,
 	sdpReplyChan chan<- webrtc.SessionDescription,
 	candidateChan <-chan webrtc.ICECandidateInit,
 	signalCandidate func(c webrtc.ICECandidateInit) error,
-	messageChan chan<- types.Message,
+	topicOfTrack func(trackId string) (string, bool),
+	messageChan chan<- recv_roschannel.TopicMessage,
+	outgoingChan <-chan recv_roschannel.TopicMessage,
 ) *PeerConnectionChannel {
 	m := &webrtc.MediaEngine{}
-	// Register VP8
-	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, Channels: 0},
-		PayloadType:        96,
-	}, webrtc.RTPCodecTypeVideo); err != nil {
-		panic(err)
+	// Register VP8, VP9 and the H.264 and AV1 decoders built in, the sender
+	// picks one per image topic
+	for _, videoCodec := range []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, Channels: 0},
+			PayloadType:        96,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, Channels: 0},
+			PayloadType:        98,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeH264,
+				ClockRate:   90000,
+				Channels:    0,
+				SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			},
+			PayloadType: 125,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeAV1,
+				ClockRate:   90000,
+				Channels:    0,
+				SDPFmtpLine: "level-idx=5;profile=0;tier=0",
+			},
+			PayloadType: 99,
+		},
+	} {
+		if !canDecode(videoCodec.MimeType) {
+			continue
+		}
+		if err := m.RegisterCodec(videoCodec, webrtc.RTPCodecTypeVideo); err != nil {
+			panic(err)
+		}
 	}
 
 	registerHeaderExtensionURI(m, []string{
@@ -69,49 +116,76 @@ func InitPeerConnectionChannel(
 		panic(err)
 	}
 	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
-	peerConnection, err := api.NewPeerConnection(config)
+	rtcConfig := cfg.RTCConfiguration()
+	peerConnection, err := api.NewPeerConnection(rtcConfig)
 	if err != nil {
 		panic(err)
 	}
 	return &PeerConnectionChannel{
+		cfg:             cfg,
 		sdpChan:         sdpChan,
 		sdpReplyChan:    sdpReplyChan,
 		candidateChan:   candidateChan,
 		peerConnection:  peerConnection,
 		signalCandidate: signalCandidate,
+		topicOfTrack:    topicOfTrack,
 		messageChan:     messageChan,
+		outgoingChan:    outgoingChan,
+		dataChannels:    make(map[string]*webrtc.DataChannel),
+		done:            make(chan struct{}),
 	}
 }
 
+// Close tears down the peer connection.
+func (pc *PeerConnectionChannel) Close() {
+	pc.closeOnce.Do(func() {
+		close(pc.done)
+		if err := pc.peerConnection.Close(); err != nil {
+			slog.Error("failed to close peer connection", "error", err)
+		}
+	})
+}
+
+// Done is closed once the peer connection has failed or been closed.
+func (pc *PeerConnectionChannel) Done() <-chan struct{} {
+	return pc.done
+}
+
 func handleSignalingMessage(pc *PeerConnectionChannel) {
 	for {
 		select {
+		case <-pc.done:
+			return
 		case sdp := <-pc.sdpChan:
 			slog.Info("received SDP", "sdp", sdp.SDP)
 			err := pc.peerConnection.SetRemoteDescription(sdp)
 			if err != nil {
-				panic(err)
+				slog.Error("failed to set remote description", "error", err)
+				pc.Close()
+				return
 			}
 			answer, err := pc.peerConnection.CreateAnswer(nil)
 			if err != nil {
-				panic(err)
+				slog.Error("failed to create answer", "error", err)
+				pc.Close()
+				return
+			}
+			select {
+			case pc.sdpReplyChan <- answer:
+			case <-pc.done:
+				return
 			}
-			pc.sdpReplyChan <- answer
 			err = pc.peerConnection.SetLocalDescription(answer)
 			if err != nil {
-				panic(err)
+				slog.Error("failed to set local description", "error", err)
+				pc.Close()
+				return
 			}
 		case candidate := <-pc.candidateChan:
 			err := pc.peerConnection.AddICECandidate(candidate)
 			if err != nil {
-				panic(err)
+				slog.Error("failed to add ICE candidate", "error", err)
+				continue
 			}
 			slog.Info("received ICE candidate", "candidate", candidate)
 		}
@@ -119,64 +193,204 @@ func handleSignalingMessage(pc *PeerConnectionChannel) {
 }
 
 func (pc *PeerConnectionChannel) Spin() {
-	webmSaver := newWebmSaver(pc.messageChan)
-	_, err := pc.peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
-		webrtc.RTPTransceiverInit{
-			Direction: webrtc.RTPTransceiverDirectionRecvonly,
-		},
-	)
-	if err != nil {
-		panic(err)
+	// one video transceiver for every image topic
+	for _, topic := range pc.cfg.Topics {
+		if topic.Type != consts.MSG_IMAGE {
+			continue
+		}
+		_, err := pc.peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+			webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			},
+		)
+		if err != nil {
+			panic(err)
+		}
 	}
+	pc.peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		slog.Info("peer connection state changed", "state", state)
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			// closing waits for the peer connection, which is running this handler
+			go pc.Close()
+		}
+	})
 	pc.peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
 			return
 		}
 		if err := pc.signalCandidate(c.ToJSON()); err != nil {
-			panic(err)
+			slog.Error("failed to signal ICE candidate", "error", err)
 		}
 	})
 	pc.peerConnection.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
 		slog.Info("PeerConnectionChannel: received track", "track", track.ID())
-		if track.Kind() == webrtc.RTPCodecTypeVideo {
-			// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-			go func() {
-				ticker := time.NewTicker(time.Second * 3)
-				for range ticker.C {
-					errSend := pc.peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
-					if errSend != nil {
-						fmt.Println(errSend)
-					}
-				}
-			}()
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			return
 		}
+		topic, ok := pc.topicOfTrack(track.ID())
+		if !ok {
+			slog.Warn("ignoring track not requested for any image topic", "track", track.ID())
+			return
+		}
+		slog.Info("decoding track", "track", track.ID(), "codec", track.Codec().MimeType)
+		webmSaver := newWebmSaver(topic, track.Codec().MimeType, pc.messageChan)
+		defer webmSaver.Close()
+		// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
+		go func() {
+			ticker := time.NewTicker(time.Second * 3)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-pc.done:
+					return
+				}
+				errSend := pc.peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+				if errSend != nil {
+					fmt.Println(errSend)
+				}
+			}
+		}()
 		for {
 			rtp, _, readErr := track.ReadRTP()
 			if readErr != nil {
-				panic(readErr)
+				slog.Info("track ended", "track", track.ID(), "error", readErr)
+				return
 			}
-			webmSaver.PushVP8(rtp)
+			webmSaver.Push(rtp)
 		}
 	})
+	// the sender opens one data channel per data topic, labelled with the
+	// topic's wire name
 	pc.peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
+		label := d.Label()
+		codec := pc.codecOf(label)
+		reassembler := envelope.NewReassembler(reassemblyTimeout, func(topic string, seq uint64) {
+			slog.Warn("discarding incomplete message", "topic", topic, "seq", seq)
+		})
+		go expireFragments(reassembler, pc.done)
 		d.OnMessage(func(msg webrtc.DataChannelMessage) {
-			serializedMsg := msg.Data
-			sensorMsg, err := rclgo.Deserialize(serializedMsg, sensor_msgs_msg.LaserScanTypeSupport)
+			if msg.IsString {
+				slog.Info("datachannel message", "label", label, "data", string(msg.Data))
+				return
+			}
+			fragment, err := envelope.Unmarshal(msg.Data)
 			if err != nil {
-				slog.Error("failed to deserialize sensor message", "error", err)
+				slog.Error("failed to unwrap datachannel message", "label", label, "error", err)
 				return
 			}
-			laserScanMsg, ok := sensorMsg.(*sensor_msgs_msg.LaserScan)
-			if !ok {
-				slog.Error("failed to cast sensor message to LaserScan")
+			env, err := reassembler.Add(fragment)
+			if err != nil {
+				slog.Error("failed to reassemble datachannel message", "label", label, "error", err)
+				return
+			}
+			if env == nil {
 				return
 			}
-			slog.Info("datachannel message", "frame ID", laserScanMsg.Header.FrameId)
+			payload, err := env.DecompressPayload(codec)
+			if err != nil {
+				slog.Error("failed to decompress datachannel message", "label", label, "error", err)
+				return
+			}
+			select {
+			case pc.messageChan <- recv_roschannel.TopicMessage{
+				Topic:      label,
+				Type:       env.Type,
+				Serialized: payload,
+			}:
+			case <-pc.done:
+			}
 		})
 		d.OnOpen(func() {
-			slog.Info("datachannel open", "label", d.Label(), "ID", d.ID())
-			d.SendText("Hello from receiver!")
+			slog.Info("datachannel open", "label", label, "ID", d.ID())
+			pc.dataChannelsMu.Lock()
+			pc.dataChannels[label] = d
+			pc.dataChannelsMu.Unlock()
 		})
 	})
+	go pc.sendOutgoing()
 	go handleSignalingMessage(pc)
 }
+
+// sendOutgoing sends the messages of the topics sent to the sender on their
+// data channels until the peer connection is closed. Messages of a topic are
+// dropped until its data channel is open.
+func (pc *PeerConnectionChannel) sendOutgoing() {
+	seqs := make(map[string]uint64)
+	for {
+		var msg recv_roschannel.TopicMessage
+		select {
+		case msg = <-pc.outgoingChan:
+		case <-pc.done:
+			return
+		}
+		pc.dataChannelsMu.Lock()
+		d, ok := pc.dataChannels[msg.Topic]
+		pc.dataChannelsMu.Unlock()
+		if !ok {
+			continue
+		}
+		serialized := msg.Serialized
+		if msg.Msg != nil {
+			var err error
+			serialized, err = rclgo.Serialize(msg.Msg)
+			if err != nil {
+				slog.Error("failed to serialize message", "topic", msg.Topic, "error", err)
+				continue
+			}
+		}
+		codec := pc.codecOf(msg.Topic)
+		payload, err := codec.Compress(serialized)
+		if err != nil {
+			slog.Error("failed to compress message", "topic", msg.Topic, "error", err)
+			continue
+		}
+		env := &envelope.Envelope{
+			Topic:     msg.Topic,
+			Type:      msg.Type,
+			Seq:       seqs[msg.Topic],
+			Timestamp: time.Now(),
+			Payload:   payload,
+		}
+		env.SetCompression(codec)
+		seqs[msg.Topic]++
+		messages, err := env.MarshalFragments(envelope.MaxMessageSize)
+		if err != nil {
+			slog.Error("failed to wrap message", "topic", msg.Topic, "error", err)
+			continue
+		}
+		for _, data := range messages {
+			if err := d.Send(data); err != nil {
+				slog.Error("failed to send message", "topic", msg.Topic, "error", err)
+				break
+			}
+		}
+	}
+}
+
+// codecOf returns the compression configured for the topic of a data channel.
+func (pc *PeerConnectionChannel) codecOf(label string) compression.Codec {
+	for i := range pc.cfg.Topics {
+		if pc.cfg.Topics[i].WireName(pc.cfg.Mode) == label {
+			return pc.cfg.Topics[i].Codec()
+		}
+	}
+	return compression.None
+}
+
+// expireFragments discards the incomplete messages of reassembler every
+// reassemblyTimeout until done is closed, so that a topic that stopped
+// sending doesn't keep its fragments.
+func expireFragments(reassembler *envelope.Reassembler, done <-chan struct{}) {
+	ticker := time.NewTicker(reassemblyTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			reassembler.Expire(now)
+		case <-done:
+			return
+		}
+	}
+}
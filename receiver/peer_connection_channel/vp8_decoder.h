@@ -4,9 +4,11 @@
 #include <sensor_msgs/msg/image.h>
 #include <vpx/vp8.h>
 #include <vpx/vp8dx.h>
+#include <vpx/vp9dx.h>
 #include <vpx/vpx_decoder.h>
 
 int init_decoder(vpx_codec_ctx_t *codec, unsigned int w, unsigned int h);
+int init_vp9_decoder(vpx_codec_ctx_t *codec);
 int decode_frame(vpx_codec_ctx_t *codec, const uint8_t *data, size_t data_size);
 vpx_image_t *get_frame(vpx_codec_ctx_t *codec);
 void vpx_to_ros_image(const vpx_image_t *vpx_img,
@@ -8,45 +8,115 @@ import "C"
 
 import (
 	"log/slog"
+	"strings"
 	"time"
 	"unsafe"
 
+	"github.com/3DRX/webrtc-ros-bridge/consts"
 	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+	recv_roschannel "github.com/3DRX/webrtc-ros-bridge/receiver/ros_channel"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
-	"github.com/tiiuae/rclgo/pkg/rclgo/types"
 )
 
+// frameDecoder decodes the frames of a codec built with a build tag.
+type frameDecoder interface {
+	// decode decodes one frame into ros_img, reporting false while the
+	// decoder needs more data
+	decode(data []byte, ros_img *C.sensor_msgs__msg__Image) (bool, error)
+	destroy()
+}
+
+// frameDecoders create the decoders of the codecs built in besides VP8 and
+// VP9, by mime type. H.264 and AV1 link native libraries and are only built
+// with the h264 and av1 build tags, see webm_saver_h264.go and
+// webm_saver_av1.go.
+var frameDecoders = map[string]func() (frameDecoder, error){}
+
+// canDecode reports whether the decoder of a codec is built in.
+func canDecode(mimeType string) bool {
+	if strings.EqualFold(mimeType, webrtc.MimeTypeVP8) || strings.EqualFold(mimeType, webrtc.MimeTypeVP9) {
+		return true
+	}
+	_, ok := frameDecoderOf(mimeType)
+	return ok
+}
+
+func frameDecoderOf(mimeType string) (func() (frameDecoder, error), bool) {
+	for name, newDecoder := range frameDecoders {
+		if strings.EqualFold(name, mimeType) {
+			return newDecoder, true
+		}
+	}
+	return nil, false
+}
+
+// WebmSaver decodes the video track of an image topic, in whichever of VP8,
+// VP9, H.264 and AV1 the SDP selected, and hands the images to the ROS channel.
 type WebmSaver struct {
-	vp8Builder     *samplebuilder.SampleBuilder
+	mimeType       string
+	sampleBuilder  *samplebuilder.SampleBuilder
 	videoTimestamp time.Duration
 
 	lastVideoTimestamp uint32
 	codecCtx           C.vpx_codec_ctx_t
 	codecCreated       bool
-	imgChan            chan<- types.Message
+	decoder            frameDecoder // codecs other than VP8 and VP9
+	topic              string
+	imgChan            chan<- recv_roschannel.TopicMessage
 }
 
-func newWebmSaver(imgChan chan<- types.Message) *WebmSaver {
+func newWebmSaver(topic string, mimeType string, imgChan chan<- recv_roschannel.TopicMessage) *WebmSaver {
+	var depacketizer rtp.Depacketizer
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		depacketizer = &codecs.VP9Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		depacketizer = &codecs.H264Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		depacketizer = &codecs.AV1Depacketizer{}
+	default:
+		depacketizer = &codecs.VP8Packet{}
+	}
 	return &WebmSaver{
-		vp8Builder:   samplebuilder.New(200, &codecs.VP8Packet{}, 90000),
-		imgChan:      imgChan,
-		codecCreated: false,
+		mimeType:      mimeType,
+		topic:         topic,
+		sampleBuilder: samplebuilder.New(200, depacketizer, 90000),
+		imgChan:       imgChan,
+		codecCreated:  false,
 	}
 }
 
 func (s *WebmSaver) Close() {
 	if s.codecCreated {
-		// TODO close codec
+		C.vpx_codec_destroy(&s.codecCtx)
+		s.codecCreated = false
+	}
+	if s.decoder != nil {
+		s.decoder.destroy()
+		s.decoder = nil
 	}
 }
 
-func (s *WebmSaver) PushVP8(rtpPacket *rtp.Packet) {
-	s.vp8Builder.Push(rtpPacket)
+// Push decodes the frames completed by rtpPacket.
+func (s *WebmSaver) Push(rtpPacket *rtp.Packet) {
+	switch {
+	case strings.EqualFold(s.mimeType, webrtc.MimeTypeVP9):
+		s.pushVP9(rtpPacket)
+	case strings.EqualFold(s.mimeType, webrtc.MimeTypeVP8):
+		s.pushVP8(rtpPacket)
+	default:
+		s.pushFrames(rtpPacket)
+	}
+}
+
+func (s *WebmSaver) pushVP8(rtpPacket *rtp.Packet) {
+	s.sampleBuilder.Push(rtpPacket)
 
 	for {
-		sample := s.vp8Builder.Pop()
+		sample := s.sampleBuilder.Pop()
 		if sample == nil {
 			return
 		}
@@ -69,19 +139,91 @@ func (s *WebmSaver) PushVP8(rtpPacket *rtp.Packet) {
 			slog.Error("Decode error", "errorCode", codecError)
 			continue
 		}
-		// Get decoded frames
-		var iter C.vpx_codec_iter_t
-		img := C.vpx_codec_get_frame(&s.codecCtx, &iter)
-		if img == nil {
-			slog.Error("Failed to get decoded frame")
+		s.sendVPXFrame()
+	}
+}
+
+func (s *WebmSaver) pushVP9(rtpPacket *rtp.Packet) {
+	s.sampleBuilder.Push(rtpPacket)
+
+	for {
+		sample := s.sampleBuilder.Pop()
+		if sample == nil || len(sample.Data) == 0 {
+			return
+		}
+		if !s.codecCreated {
+			if errCode := C.init_vp9_decoder(&s.codecCtx); errCode != 0 {
+				slog.Error("failed to initialize decoder", "error", errCode)
+				return
+			}
+			s.codecCreated = true
+		}
+		codecError := C.decode_frame(&s.codecCtx, (*C.uint8_t)(&sample.Data[0]), C.size_t(len(sample.Data)))
+		if codecError != 0 {
+			slog.Error("Decode error", "errorCode", codecError)
 			continue
 		}
-		var ros_img sensor_msgs_msg.Image
+		s.sendVPXFrame()
+	}
+}
+
+// pushFrames decodes the frames of codecs other than VP8 and VP9.
+func (s *WebmSaver) pushFrames(rtpPacket *rtp.Packet) {
+	s.sampleBuilder.Push(rtpPacket)
+
+	for {
+		sample := s.sampleBuilder.Pop()
+		if sample == nil || len(sample.Data) == 0 {
+			return
+		}
+		if s.decoder == nil {
+			newDecoder, ok := frameDecoderOf(s.mimeType)
+			if !ok {
+				slog.Error("no decoder built in", "codec", s.mimeType)
+				return
+			}
+			decoder, err := newDecoder()
+			if err != nil {
+				slog.Error("failed to initialize decoder", "codec", s.mimeType, "error", err)
+				return
+			}
+			s.decoder = decoder
+		}
 		var ros_img_c C.sensor_msgs__msg__Image
-		C.vpx_to_ros_image(img, &ros_img_c)
-		sensor_msgs_msg.ImageTypeSupport.AsGoStruct(&ros_img, unsafe.Pointer(&ros_img_c))
-		C.cleanup_ros_image(&ros_img_c)
-		s.imgChan <- &ros_img
+		decoded, err := s.decoder.decode(sample.Data, &ros_img_c)
+		if err != nil {
+			slog.Error("Decode error", "codec", s.mimeType, "error", err)
+			continue
+		}
+		if !decoded {
+			continue
+		}
+		s.sendImage(&ros_img_c)
+	}
+}
+
+// sendVPXFrame sends the frame the vpx decoder just decoded.
+func (s *WebmSaver) sendVPXFrame() {
+	var iter C.vpx_codec_iter_t
+	img := C.vpx_codec_get_frame(&s.codecCtx, &iter)
+	if img == nil {
+		slog.Error("Failed to get decoded frame")
+		return
+	}
+	var ros_img_c C.sensor_msgs__msg__Image
+	C.vpx_to_ros_image(img, &ros_img_c)
+	s.sendImage(&ros_img_c)
+}
+
+// sendImage sends a decoded image to the ROS channel and frees it.
+func (s *WebmSaver) sendImage(ros_img_c *C.sensor_msgs__msg__Image) {
+	var ros_img sensor_msgs_msg.Image
+	sensor_msgs_msg.ImageTypeSupport.AsGoStruct(&ros_img, unsafe.Pointer(ros_img_c))
+	C.cleanup_ros_image(ros_img_c)
+	s.imgChan <- recv_roschannel.TopicMessage{
+		Topic: s.topic,
+		Type:  consts.MSG_IMAGE,
+		Msg:   &ros_img,
 	}
 }
 
@@ -0,0 +1,44 @@
+//go:build av1
+
+package peerconnectionchannel
+
+/*
+#cgo LDFLAGS: -ldav1d
+#include "av1_decoder.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func init() {
+	frameDecoders[webrtc.MimeTypeAV1] = newAV1Decoder
+}
+
+type av1Decoder struct {
+	dec *C.av1_decoder
+}
+
+func newAV1Decoder() (frameDecoder, error) {
+	dec := C.av1_decoder_create()
+	if dec == nil {
+		return nil, errors.New("failed to initialize AV1 decoder")
+	}
+	return &av1Decoder{dec: dec}, nil
+}
+
+func (d *av1Decoder) decode(data []byte, ros_img *C.sensor_msgs__msg__Image) (bool, error) {
+	status := C.av1_decode_frame(d.dec, (*C.uint8_t)(&data[0]), C.size_t(len(data)), ros_img)
+	if status < 0 {
+		return false, fmt.Errorf("dav1d error %d", status)
+	}
+	return status > 0, nil
+}
+
+func (d *av1Decoder) destroy() {
+	C.av1_decoder_destroy(d.dec)
+}
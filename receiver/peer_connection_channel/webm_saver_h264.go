@@ -0,0 +1,44 @@
+//go:build h264
+
+package peerconnectionchannel
+
+/*
+#cgo LDFLAGS: -lopenh264
+#include "h264_decoder.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func init() {
+	frameDecoders[webrtc.MimeTypeH264] = newH264Decoder
+}
+
+type h264Decoder struct {
+	dec *C.h264_decoder
+}
+
+func newH264Decoder() (frameDecoder, error) {
+	dec := C.h264_decoder_create()
+	if dec == nil {
+		return nil, errors.New("failed to initialize H.264 decoder")
+	}
+	return &h264Decoder{dec: dec}, nil
+}
+
+func (d *h264Decoder) decode(data []byte, ros_img *C.sensor_msgs__msg__Image) (bool, error) {
+	status := C.h264_decode_frame(d.dec, (*C.uint8_t)(&data[0]), C.size_t(len(data)), ros_img)
+	if status < 0 {
+		return false, fmt.Errorf("openh264 decoding state %d", status)
+	}
+	return status > 0, nil
+}
+
+func (d *h264Decoder) destroy() {
+	C.h264_decoder_destroy(d.dec)
+}
@@ -0,0 +1,62 @@
+// yuv_image.c
+#include "yuv_image.h"
+#include <rosidl_runtime_c/primitives_sequence_functions.h>
+#include <rosidl_runtime_c/string_functions.h>
+#include <stdlib.h>
+
+// Converts a decoded I420 frame into a ROS image
+void yuv420_to_ros_image(uint8_t *const planes[3], const int strides[3],
+                         unsigned int width, unsigned int height,
+                         sensor_msgs__msg__Image *ros_img) {
+  // Initialize ROS message
+  sensor_msgs__msg__Image__init(ros_img);
+
+  // Set image dimensions
+  ros_img->width = width;
+  ros_img->height = height;
+
+  // Set encoding to rgb8 since we'll convert to RGB
+  rosidl_runtime_c__String__init(&ros_img->encoding);
+  rosidl_runtime_c__String__assign(&ros_img->encoding, "rgb8");
+
+  // Set step (3 bytes per pixel for RGB)
+  ros_img->step = ros_img->width * 3;
+
+  // Allocate data array
+  size_t data_size = ros_img->step * ros_img->height;
+  rosidl_runtime_c__uint8__Sequence *seq = &ros_img->data;
+  seq->data = (uint8_t *)malloc(data_size * sizeof(uint8_t));
+  seq->size = data_size;
+  seq->capacity = data_size;
+
+  // Convert and copy data
+  for (int y = 0; y < ros_img->height; y++) {
+    for (int x = 0; x < ros_img->width; x++) {
+      // Calculate correct indices using strides
+      int y_idx = y * strides[0] + x;
+      int u_idx = (y >> 1) * strides[1] + (x >> 1);
+      int v_idx = (y >> 1) * strides[2] + (x >> 1);
+
+      // Get YUV values
+      int Y = planes[0][y_idx];
+      int U = planes[1][u_idx] - 128;
+      int V = planes[2][v_idx] - 128;
+
+      // YUV to RGB conversion
+      int R = Y + (1.403 * V);
+      int G = Y - (0.344 * U) - (0.714 * V);
+      int B = Y + (1.770 * U);
+
+      // Clamp values to [0, 255]
+      R = R < 0 ? 0 : (R > 255 ? 255 : R);
+      G = G < 0 ? 0 : (G > 255 ? 255 : G);
+      B = B < 0 ? 0 : (B > 255 ? 255 : B);
+
+      // Write to destination in RGB order
+      int dest_idx = (y * ros_img->width + x) * 3;
+      seq->data[dest_idx + 0] = (unsigned char)R;
+      seq->data[dest_idx + 1] = (unsigned char)G;
+      seq->data[dest_idx + 2] = (unsigned char)B;
+    }
+  }
+}
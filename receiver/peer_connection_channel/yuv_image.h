@@ -0,0 +1,11 @@
+#ifndef YUV_IMAGE_H_
+#define YUV_IMAGE_H_
+
+#include <sensor_msgs/msg/image.h>
+#include <stdint.h>
+
+void yuv420_to_ros_image(uint8_t *const planes[3], const int strides[3],
+                         unsigned int width, unsigned int height,
+                         sensor_msgs__msg__Image *ros_img);
+
+#endif // YUV_IMAGE_H_
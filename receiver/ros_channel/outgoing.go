@@ -0,0 +1,79 @@
+package roschannel
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/3DRX/webrtc-ros-bridge/dropcount"
+)
+
+// outgoingQueueSize is the number of messages a session can be behind on
+// before messages are dropped.
+const outgoingQueueSize = 16
+
+// Outgoing hands the messages of the topics sent to the sender to the
+// current session. Every session gets its own queue, so that no stale
+// message, e.g. a control command, reaches the sender after a reconnection.
+type Outgoing struct {
+	mu    sync.Mutex
+	queue chan TopicMessage // nil while there is no session
+	drops map[string]*dropcount.Counter
+}
+
+func NewOutgoing() *Outgoing {
+	return &Outgoing{drops: make(map[string]*dropcount.Counter)}
+}
+
+// Open starts a session, returning the queue it reads the messages from
+// until Close.
+func (o *Outgoing) Open() <-chan TopicMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queue = make(chan TopicMessage, outgoingQueueSize)
+	return o.queue
+}
+
+// Close ends the session, dropping the messages it hasn't read.
+func (o *Outgoing) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queue = nil
+}
+
+// put queues msg for the session without blocking. It is dropped when
+// there is no session or the session is too far behind.
+func (o *Outgoing) put(msg TopicMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.queue == nil {
+		o.drop(msg.Topic, "no session to send to, dropping messages")
+		return
+	}
+	select {
+	case o.queue <- msg:
+	default:
+		o.drop(msg.Topic, "session is behind, dropping messages")
+	}
+}
+
+func (o *Outgoing) drop(topic string, reason string) {
+	drops, ok := o.drops[topic]
+	if !ok {
+		drops = &dropcount.Counter{}
+		o.drops[topic] = drops
+	}
+	if dropped := drops.Drop(time.Now()); dropped > 0 {
+		slog.Warn(reason, "topic", topic, "dropped", dropped)
+	}
+}
+
+// Dropped returns the number of messages of a topic dropped so far.
+func (o *Outgoing) Dropped(topic string) uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if drops, ok := o.drops[topic]; ok {
+		return drops.Total()
+	}
+	return 0
+}
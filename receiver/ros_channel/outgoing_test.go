@@ -0,0 +1,38 @@
+package roschannel
+
+import "testing"
+
+func TestOutgoingSessions(t *testing.T) {
+	o := NewOutgoing()
+	o.put(TopicMessage{Topic: "cmd_vel", Serialized: []byte{0}})
+	if o.Dropped("cmd_vel") != 1 {
+		t.Errorf("expected the message without session to be dropped, got %d drops", o.Dropped("cmd_vel"))
+	}
+
+	queue := o.Open()
+	for i := 0; i < outgoingQueueSize; i++ {
+		o.put(TopicMessage{Topic: "cmd_vel", Serialized: []byte{byte(i + 1)}})
+	}
+	if o.Dropped("cmd_vel") != 1 {
+		t.Errorf("expected a busy session to queue %d messages, got %d drops", outgoingQueueSize, o.Dropped("cmd_vel")-1)
+	}
+	o.put(TopicMessage{Topic: "cmd_vel", Serialized: []byte{0}})
+	if o.Dropped("cmd_vel") != 2 {
+		t.Errorf("expected the message past the queue to be dropped, got %d drops", o.Dropped("cmd_vel")-1)
+	}
+	for i := 0; i < outgoingQueueSize; i++ {
+		if msg := <-queue; msg.Serialized[0] != byte(i+1) {
+			t.Fatalf("message %d out of order: %v", i, msg.Serialized)
+		}
+	}
+
+	// the next session doesn't get the messages of the previous one
+	o.put(TopicMessage{Topic: "cmd_vel", Serialized: []byte{0}})
+	o.Close()
+	queue = o.Open()
+	select {
+	case msg := <-queue:
+		t.Errorf("stale message %v reached the next session", msg.Serialized)
+	default:
+	}
+}
@@ -1,358 +1,304 @@
 package roschannel
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"image"
 	"log/slog"
-	"strings"
 	"time"
 
 	"github.com/3DRX/webrtc-ros-bridge/config"
 	"github.com/3DRX/webrtc-ros-bridge/consts"
-	geom_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/geometry_msgs/msg"
-	nav_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/nav_msgs/msg"
 	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+	"github.com/3DRX/webrtc-ros-bridge/registry"
 	"github.com/tiiuae/rclgo/pkg/rclgo"
 	"github.com/tiiuae/rclgo/pkg/rclgo/types"
-
-	// 导入Autoware消息类型
-	control_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/autoware_control_msgs/msg"
-	planning_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/autoware_planning_msgs/msg"
-	vehicle_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/autoware_vehicle_msgs/msg"
 )
 
+type topicPublisher struct {
+	topic       config.TopicConfig
+	typeSupport types.MessageTypeSupport
+	dynamic     bool // type support loaded at runtime, publish serialized only
+	pub         *rclgo.Publisher
+	fps         *fpsCounter // only set for image topics
+}
+
+// TopicMessage is a message received from the sender, either already
+// decoded (Msg, e.g. video frames) or still serialized (Serialized, e.g.
+// data channel payloads).
+type TopicMessage struct {
+	Topic      string // matched against name_in
+	Type       string
+	Msg        types.Message
+	Serialized []byte
+}
+
+// ROIRequest asks the sender to send only a region of the images of a topic.
+type ROIRequest struct {
+	Topic string          // name_in of the image topic
+	Crop  image.Rectangle // empty to restore the configured crop
+}
+
 type ROSChannel struct {
-	chanDispatcher func()
-	messageChan    <-chan types.Message
-	cfg            *config.Config
-	topicIdx       int
+	messageChan   <-chan TopicMessage
+	node          *rclgo.Node
+	publishers    []*topicPublisher
+	subscriptions []*rclgo.Subscription
 }
 
+// InitROSChannel publishes the topics coming from the sender on messageChan,
+// and subscribes to the topics sent to the sender, handing their messages to
+// the session of outgoing with Topic set to name_out. The regions published on the
+// "<name_out>/roi" topic of each image topic are handed to roiChan.
 func InitROSChannel(
 	cfg *config.Config,
-	topicIdx int,
-	messageChan <-chan types.Message,
+	messageChan <-chan TopicMessage,
+	outgoing *Outgoing,
+	roiChan chan<- ROIRequest,
 ) *ROSChannel {
-	return &ROSChannel{
-		cfg:         cfg,
-		topicIdx:    topicIdx,
-		messageChan: messageChan,
-	}
-}
-
-func (r *ROSChannel) Spin() {
+	nodeName := "webrtc_ros_bridge_" + cfg.Mode
+	slog.Info("creating node", "name", nodeName)
 	err := rclgo.Init(nil)
 	if err != nil {
 		panic(err)
 	}
-
-	// 创建一个有意义的节点名称
-	topicName := r.cfg.Topics[r.topicIdx].NameOut
-	topicType := r.cfg.Topics[r.topicIdx].Type
-
-	// 替换不合法字符，ROS节点名称中不能包含 "/" 等特殊字符
-	nodeName := "webrtc_ros_bridge_" + r.cfg.Mode + "_" + strings.ReplaceAll(topicType, "/", "_") + "_" + strings.ReplaceAll(topicName, "/", "_")
 	node, err := rclgo.NewNode(nodeName, "")
 	if err != nil {
 		panic(err)
 	}
-	defer node.Close()
-	defer rclgo.Uninit()
-
-	// 创建相应类型的发布者
-	switch r.cfg.Topics[r.topicIdx].Type {
-	case consts.MSG_IMAGE:
-		r.handleImageMessages(node)
-
-	case consts.MSG_LASER_SCAN:
-		r.handleLaserScanMessages(node)
-
-	case consts.MSG_KINEMATIC:
-		r.handleKinematicMessages(node)
-
-	case consts.MSG_POSE_COV:
-		r.handlePoseCovMessages(node)
-
-	// Autoware特定的消息类型 - 当生成绑定后取消注释
-	case consts.MSG_CONTROL_CMD:
-		r.handleControlCmdMessages(node)
-
-	case consts.MSG_TRAJECTORY:
-		r.handleTrajectoryMessages(node)
-
-	case consts.MSG_CONTROL_MODE:
-		r.handleControlModeMessages(node)
-
-	case consts.MSG_VELOCITY:
-		r.handleVelocityMessages(node)
-
-	case consts.MSG_STEERING:
-		r.handleSteeringMessages(node)
-
-	case consts.MSG_GEAR:
-		r.handleGearMessages(node)
-
-	default:
-		slog.Error("Unsupported message type", "type", r.cfg.Topics[r.topicIdx].Type)
-		return
-	}
-}
-
-// 处理图像消息
-func (r *ROSChannel) handleImageMessages(node *rclgo.Node) {
-	pub, err := sensor_msgs_msg.NewImagePublisher(node, "/"+r.cfg.Topics[r.topicIdx].NameOut, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer pub.Close()
-
-	// FPS计算相关变量
-	const windowSize = 30
-	timestamps := make([]time.Time, windowSize)
-	frameCount := 0
-	idx := 0
-	firstFrame := true
-	lastPrintTime := time.Now()
-
-	for {
-		msg := <-r.messageChan
-		img, ok := msg.(*sensor_msgs_msg.Image)
-		if !ok {
-			slog.Error("Received message is not an Image", "type", fmt.Sprintf("%T", msg))
+	// create publishers based on topic types
+	pubs := make([]*topicPublisher, 0, len(cfg.Topics))
+	subs := make([]*rclgo.Subscription, 0)
+	for _, topic := range cfg.Topics {
+		if topic.SubscribedBy(cfg.Mode) {
+			sub, err := subscribe(node, topic, outgoing)
+			if err != nil {
+				panic(err)
+			}
+			subs = append(subs, sub)
 			continue
 		}
-
-		now := time.Now()
-		err := pub.Publish(img)
-		if err != nil {
-			slog.Error("Failed to publish image message", "error", err)
+		opts := &rclgo.PublisherOptions{Qos: *(topic.Qos)}
+		ts, ok := registry.Lookup(topic.Type)
+		if !ok && !cfg.DynamicTypes {
+			slog.Warn("unsupported topic type", "type", topic.Type)
+			continue // 跳过不支持的类型
 		}
-
-		// FPS计算
-		if firstFrame {
-			timestamps[0] = now
-			firstFrame = false
-			frameCount = 1
-			continue
+		var pub *rclgo.Publisher
+		if ok {
+			pub, err = registry.NewPublisher(node, "/"+topic.NameOut, topic.Type, opts)
+		} else {
+			pub, err = registry.NewDynamicPublisher(node, "/"+topic.NameOut, topic.Type, opts)
 		}
-		idx = (idx + 1) % windowSize
-		timestamps[idx] = now
-		if frameCount < windowSize {
-			frameCount++
+		if err != nil {
+			panic(err)
 		}
-		if now.Sub(lastPrintTime) >= time.Second {
-			if frameCount < 2 {
-				slog.Info("FPS calculation pending, need more frames")
-				continue
-			}
-			oldestIdx := (idx - frameCount + 1 + windowSize) % windowSize
-			duration := timestamps[idx].Sub(timestamps[oldestIdx])
-			if duration.Seconds() > 0 {
-				fps := float64(frameCount-1) / duration.Seconds()
-				slog.Info("Current FPS", "fps", fmt.Sprintf("%.2f", fps))
+		tp := &topicPublisher{
+			topic:       topic,
+			typeSupport: ts,
+			dynamic:     !ok,
+			pub:         pub,
+		}
+		if topic.Type == consts.MSG_IMAGE {
+			tp.fps = newFPSCounter()
+			sub, err := subscribeROI(node, topic, roiChan)
+			if err != nil {
+				panic(err)
 			}
-			lastPrintTime = now
+			subs = append(subs, sub)
 		}
+		pubs = append(pubs, tp)
+		slog.Info("created publisher", "topic", pub.TopicName, "type", topic.Type)
 	}
-}
-
-// 处理激光雷达消息
-func (r *ROSChannel) handleLaserScanMessages(node *rclgo.Node) {
-	pub, err := sensor_msgs_msg.NewLaserScanPublisher(node, "/"+r.cfg.Topics[r.topicIdx].NameOut, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer pub.Close()
-
-	for {
-		msg := <-r.messageChan
-		scan, ok := msg.(*sensor_msgs_msg.LaserScan)
-		if !ok {
-			slog.Error("Received message is not a LaserScan", "type", fmt.Sprintf("%T", msg))
-			continue
-		}
-
-		err := pub.Publish(scan)
-		if err != nil {
-			slog.Error("Failed to publish laser scan message", "error", err)
-		}
+	return &ROSChannel{
+		messageChan:   messageChan,
+		node:          node,
+		publishers:    pubs,
+		subscriptions: subs,
 	}
 }
 
-// 处理运动学状态消息
-func (r *ROSChannel) handleKinematicMessages(node *rclgo.Node) {
-	pub, err := nav_msgs.NewOdometryPublisher(node, "/"+r.cfg.Topics[r.topicIdx].NameOut, nil)
-	if err != nil {
-		panic(err)
+// subscribe subscribes to a topic sent to the sender, handing its messages
+// to the current session of outgoing.
+func subscribe(node *rclgo.Node, topic config.TopicConfig, outgoing *Outgoing) (*rclgo.Subscription, error) {
+	topicPath := "/" + topic.NameIn
+	opts := &rclgo.SubscriptionOptions{Qos: *(topic.Qos)}
+	deliver := outgoing.put
+	var sub *rclgo.Subscription
+	var err error
+	if registry.IsSupported(topic.Type) {
+		sub, err = registry.Subscribe(node, topicPath, topic.Type, opts,
+			func(msg types.Message, info *rclgo.MessageInfo, err error) {
+				if err != nil {
+					slog.Error("failed to take message", "topic", topicPath, "error", err)
+					return
+				}
+				deliver(TopicMessage{Topic: topic.NameOut, Type: topic.Type, Msg: msg})
+			},
+		)
+	} else {
+		// no generated bindings, pass the serialized CDR through
+		sub, err = registry.SubscribeSerialized(node, topicPath, topic.Type, opts,
+			func(msg []byte, info *rclgo.MessageInfo, err error) {
+				if err != nil {
+					slog.Error("failed to take message", "topic", topicPath, "error", err)
+					return
+				}
+				deliver(TopicMessage{Topic: topic.NameOut, Type: topic.Type, Serialized: msg})
+			},
+		)
 	}
-	defer pub.Close()
-
-	for {
-		msg := <-r.messageChan
-		odom, ok := msg.(*nav_msgs.Odometry)
-		if !ok {
-			slog.Error("Received message is not an Odometry", "type", fmt.Sprintf("%T", msg))
-			continue
-		}
-
-		err := pub.Publish(odom)
-		if err != nil {
-			slog.Error("Failed to publish odometry message", "error", err)
-		}
+	if err != nil {
+		return nil, err
 	}
+	slog.Info("subscribed", "topic", topicPath, "type", topic.Type)
+	return sub, nil
 }
 
-// 处理位姿协方差消息
-func (r *ROSChannel) handlePoseCovMessages(node *rclgo.Node) {
-	pub, err := geom_msgs.NewPoseWithCovarianceStampedPublisher(node, "/"+r.cfg.Topics[r.topicIdx].NameOut, nil)
+// subscribeROI subscribes to the sensor_msgs/msg/RegionOfInterest topic
+// "<name_out>/roi" of an image topic, where the region of the images to send
+// can be changed at runtime. A region of zero width or height restores the
+// configured crop. Requests are dropped when no session is waiting for them.
+func subscribeROI(node *rclgo.Node, topic config.TopicConfig, roiChan chan<- ROIRequest) (*rclgo.Subscription, error) {
+	topicPath := "/" + topic.NameOut + "/roi"
+	sub, err := sensor_msgs_msg.NewRegionOfInterestSubscription(node, topicPath, nil,
+		func(msg *sensor_msgs_msg.RegionOfInterest, info *rclgo.MessageInfo, err error) {
+			if err != nil {
+				slog.Error("failed to take message", "topic", topicPath, "error", err)
+				return
+			}
+			x, y := int(msg.XOffset), int(msg.YOffset)
+			request := ROIRequest{
+				Topic: topic.NameIn,
+				Crop:  image.Rect(x, y, x+int(msg.Width), y+int(msg.Height)),
+			}
+			select {
+			case roiChan <- request:
+			default:
+				slog.Warn("no session to send to, dropping ROI request", "topic", topicPath)
+			}
+		},
+	)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer pub.Close()
+	slog.Info("subscribed", "topic", topicPath, "type", "sensor_msgs/msg/RegionOfInterest")
+	return sub.Subscription, nil
+}
 
-	for {
-		msg := <-r.messageChan
-		pose, ok := msg.(*geom_msgs.PoseWithCovarianceStamped)
-		if !ok {
-			slog.Error("Received message is not a PoseWithCovarianceStamped", "type", fmt.Sprintf("%T", msg))
-			continue
+func (r *ROSChannel) Spin() {
+	defer rclgo.Uninit()
+	defer r.node.Close()
+	defer func() {
+		for _, p := range r.publishers {
+			p.pub.Close()
 		}
-
-		err := pub.Publish(pose)
+		for _, sub := range r.subscriptions {
+			sub.Close()
+		}
+	}()
+	if len(r.subscriptions) > 0 {
+		ws, err := rclgo.NewWaitSet()
 		if err != nil {
-			slog.Error("Failed to publish pose message", "error", err)
+			panic(err)
 		}
+		defer ws.Close()
+		ws.AddSubscriptions(r.subscriptions...)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go ws.Run(ctx)
 	}
-}
-
-// Autoware特定的消息处理函数 - 当生成绑定后取消注释
-func (r *ROSChannel) handleControlCmdMessages(node *rclgo.Node) {
-	pub, err := control_msgs.NewControlPublisher(node, "/"+r.cfg.Topics[r.topicIdx].NameOut, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer pub.Close()
-
 	for {
 		msg := <-r.messageChan
-		cmd, ok := msg.(*control_msgs.Control)
-		if !ok {
-			slog.Error("Received message is not a Control message", "type", fmt.Sprintf("%T", msg))
-			continue
-		}
-
-		err := pub.Publish(cmd)
+		p, err := r.publisherFor(&msg)
 		if err != nil {
-			slog.Error("Failed to publish control command message", "error", err)
+			slog.Error("dropping received message", "topic", msg.Topic, "type", msg.Type, "error", err)
+			continue
 		}
-	}
-}
-
-func (r *ROSChannel) handleTrajectoryMessages(node *rclgo.Node) {
-	pub, err := planning_msgs.NewTrajectoryPublisher(node, "/"+r.cfg.Topics[r.topicIdx].NameOut, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer pub.Close()
-
-	for {
-		msg := <-r.messageChan
-		traj, ok := msg.(*planning_msgs.Trajectory)
-		if !ok {
-			slog.Error("Received message is not a Trajectory", "type", fmt.Sprintf("%T", msg))
+		if p.dynamic {
+			if err := p.pub.PublishSerialized(msg.Serialized); err != nil {
+				slog.Error("failed to publish serialized message", "topic", p.pub.TopicName, "error", err)
+			}
 			continue
 		}
-
-		err := pub.Publish(traj)
-		if err != nil {
-			slog.Error("Failed to publish trajectory message", "error", err)
+		rosMsg := msg.Msg
+		if rosMsg == nil {
+			rosMsg, err = rclgo.Deserialize(msg.Serialized, p.typeSupport)
+			if err != nil {
+				slog.Error("failed to deserialize message", "topic", msg.Topic, "type", msg.Type, "error", err)
+				continue
+			}
 		}
-	}
-}
-
-func (r *ROSChannel) handleControlModeMessages(node *rclgo.Node) {
-	pub, err := vehicle_msgs.NewControlModeReportPublisher(node, "/"+r.cfg.Topics[r.topicIdx].NameOut, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer pub.Close()
-
-	for {
-		msg := <-r.messageChan
-		mode, ok := msg.(*vehicle_msgs.ControlModeReport)
-		if !ok {
-			slog.Error("Received message is not a ControlModeReport", "type", fmt.Sprintf("%T", msg))
+		if err := p.pub.Publish(rosMsg); err != nil {
+			slog.Error("failed to publish message", "topic", p.pub.TopicName, "error", err)
 			continue
 		}
-
-		err := pub.Publish(mode)
-		if err != nil {
-			slog.Error("Failed to publish control mode message", "error", err)
+		if p.fps != nil {
+			p.fps.tick(p.pub.TopicName)
 		}
 	}
 }
 
-func (r *ROSChannel) handleVelocityMessages(node *rclgo.Node) {
-	pub, err := vehicle_msgs.NewVelocityReportPublisher(node, "/"+r.cfg.Topics[r.topicIdx].NameOut, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer pub.Close()
-
-	for {
-		msg := <-r.messageChan
-		vel, ok := msg.(*vehicle_msgs.VelocityReport)
-		if !ok {
-			slog.Error("Received message is not a VelocityReport", "type", fmt.Sprintf("%T", msg))
+// publisherFor finds the publisher of the topic a message was sent on and
+// checks that the announced message type matches the configured one.
+func (r *ROSChannel) publisherFor(msg *TopicMessage) (*topicPublisher, error) {
+	for _, p := range r.publishers {
+		if p.topic.NameIn != msg.Topic {
 			continue
 		}
-
-		err := pub.Publish(vel)
-		if err != nil {
-			slog.Error("Failed to publish velocity message", "error", err)
+		if p.topic.Type != msg.Type {
+			return nil, fmt.Errorf("type mismatch, expected %s", p.topic.Type)
 		}
+		return p, nil
 	}
+	return nil, errors.New("topic not configured")
 }
 
-func (r *ROSChannel) handleSteeringMessages(node *rclgo.Node) {
-	pub, err := vehicle_msgs.NewSteeringReportPublisher(node, "/"+r.cfg.Topics[r.topicIdx].NameOut, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer pub.Close()
+// fpsCounter logs the publishing rate of an image topic over a sliding window.
+type fpsCounter struct {
+	timestamps    []time.Time
+	frameCount    int
+	idx           int
+	firstFrame    bool
+	lastPrintTime time.Time
+}
 
-	for {
-		msg := <-r.messageChan
-		steering, ok := msg.(*vehicle_msgs.SteeringReport)
-		if !ok {
-			slog.Error("Received message is not a SteeringReport", "type", fmt.Sprintf("%T", msg))
-			continue
-		}
+// FPS计算相关变量
+const fpsWindowSize = 30
 
-		err := pub.Publish(steering)
-		if err != nil {
-			slog.Error("Failed to publish steering message", "error", err)
-		}
+func newFPSCounter() *fpsCounter {
+	return &fpsCounter{
+		timestamps:    make([]time.Time, fpsWindowSize),
+		firstFrame:    true,
+		lastPrintTime: time.Now(),
 	}
 }
 
-func (r *ROSChannel) handleGearMessages(node *rclgo.Node) {
-	pub, err := vehicle_msgs.NewGearReportPublisher(node, "/"+r.cfg.Topics[r.topicIdx].NameOut, nil)
-	if err != nil {
-		panic(err)
+func (f *fpsCounter) tick(topicName string) {
+	now := time.Now()
+	if f.firstFrame {
+		f.timestamps[0] = now
+		f.firstFrame = false
+		f.frameCount = 1
+		return
 	}
-	defer pub.Close()
-
-	for {
-		msg := <-r.messageChan
-		gear, ok := msg.(*vehicle_msgs.GearReport)
-		if !ok {
-			slog.Error("Received message is not a GearReport", "type", fmt.Sprintf("%T", msg))
-			continue
+	f.idx = (f.idx + 1) % fpsWindowSize
+	f.timestamps[f.idx] = now
+	if f.frameCount < fpsWindowSize {
+		f.frameCount++
+	}
+	if now.Sub(f.lastPrintTime) >= time.Second {
+		if f.frameCount < 2 {
+			slog.Info("FPS calculation pending, need more frames", "topic", topicName)
+			return
 		}
-
-		err := pub.Publish(gear)
-		if err != nil {
-			slog.Error("Failed to publish gear message", "error", err)
+		oldestIdx := (f.idx - f.frameCount + 1 + fpsWindowSize) % fpsWindowSize
+		duration := f.timestamps[f.idx].Sub(f.timestamps[oldestIdx])
+		if duration.Seconds() > 0 {
+			fps := float64(f.frameCount-1) / duration.Seconds()
+			slog.Info("Current FPS", "topic", topicName, "fps", fmt.Sprintf("%.2f", fps))
 		}
+		f.lastPrintTime = now
 	}
 }
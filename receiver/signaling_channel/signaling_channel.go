@@ -2,25 +2,36 @@ package signalingchannel
 
 import (
 	"encoding/json"
+	"errors"
+	"image"
 	"log/slog"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/3DRX/webrtc-ros-bridge/consts"
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 	"golang.org/x/exp/rand"
 )
 
+// SignalingChannel is the signaling session with the sender, from Connect
+// until the websocket is closed from either side.
 type SignalingChannel struct {
 	cfg           *config.Config
-	topicIdx      int
+	trackTopics   map[string]string // video track ID -> name_in of its image topic
 	recv          chan []byte
 	c             *websocket.Conn
+	writeMu       sync.Mutex
+	done          chan struct{}
+	closeOnce     sync.Once
 	sdpChan       chan<- webrtc.SessionDescription
 	sdpReplyChan  <-chan webrtc.SessionDescription
 	candidateChan chan<- webrtc.ICECandidateInit
+	answered      atomic.Bool // set once the answer is sent, see RequestROI
 }
 
 type signalingResponse struct {
@@ -37,16 +48,16 @@ type ICECandidateJSON struct {
 
 func InitSignalingChannel(
 	cfg *config.Config,
-	topicIdx int,
 	sdpChan chan webrtc.SessionDescription,
 	sdpReplyChan <-chan webrtc.SessionDescription,
 	candidateChan chan<- webrtc.ICECandidateInit,
 ) *SignalingChannel {
 	return &SignalingChannel{
 		cfg:           cfg,
-		topicIdx:      topicIdx,
+		trackTopics:   make(map[string]string),
 		recv:          make(chan []byte),
 		c:             nil,
+		done:          make(chan struct{}),
 		sdpChan:       sdpChan,
 		sdpReplyChan:  sdpReplyChan,
 		candidateChan: candidateChan,
@@ -59,24 +70,40 @@ func newStreamId() string {
 
 func (s *SignalingChannel) composeActions() map[string]interface{} {
 	streamId := newStreamId()
-	action := map[string]interface{}{
-		"type": "configure",
-		"actions": []map[string]interface{}{
-			{
-				"type": "add_stream",
-				"id":   streamId,
-			},
-			{
-				"type":      "add_video_track",
-				"stream_id": streamId,
-				"id":        streamId + "/subscribed_video",
-				"src":       "ros_image:/" + s.cfg.Topics[s.topicIdx].NameIn,
-			},
+	actions := []map[string]interface{}{
+		{
+			"type": "add_stream",
+			"id":   streamId,
 		},
 	}
+	// request one video track for every image topic in the config
+	for _, topic := range s.cfg.Topics {
+		if topic.Type != consts.MSG_IMAGE {
+			continue
+		}
+		trackId := streamId + "/subscribed_video_" + topic.NameIn
+		s.trackTopics[trackId] = topic.NameIn
+		actions = append(actions, map[string]interface{}{
+			"type":      "add_video_track",
+			"stream_id": streamId,
+			"id":        trackId,
+			"src":       "ros_image:/" + topic.NameIn,
+		})
+	}
+	action := map[string]interface{}{
+		"type":    "configure",
+		"actions": actions,
+	}
 	return action
 }
 
+// TopicOfTrack returns the name_in of the image topic a video track was
+// requested for.
+func (s *SignalingChannel) TopicOfTrack(trackId string) (string, bool) {
+	topic, ok := s.trackTopics[trackId]
+	return topic, ok
+}
+
 func toTextMessage(data map[string]interface{}) ([]byte, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -96,60 +123,151 @@ func (s *SignalingChannel) SignalCandidate(candidate webrtc.ICECandidateInit) er
 	if err != nil {
 		slog.Error("marshal error", "error", err)
 	}
-	s.c.WriteMessage(websocket.TextMessage, payload)
+	if err := s.write(payload); err != nil {
+		return err
+	}
 	slog.Info("send candidate", "candidate", string(payload))
 	return nil
 }
 
-func (s *SignalingChannel) Spin() {
+// RequestROI asks the sender to send only the crop region of the images of
+// the image topic named name_in, an empty crop restores the configured one.
+// It can only be sent once the session is negotiated.
+func (s *SignalingChannel) RequestROI(topic string, crop image.Rectangle) error {
+	if !s.answered.Load() {
+		return errors.New("session isn't negotiated yet")
+	}
+	roiMsg := map[string]interface{}{
+		"type":   "set_roi",
+		"src":    "ros_image:/" + topic,
+		"x":      crop.Min.X,
+		"y":      crop.Min.Y,
+		"width":  crop.Dx(),
+		"height": crop.Dy(),
+	}
+	payload, err := toTextMessage(roiMsg)
+	if err != nil {
+		return err
+	}
+	if err := s.write(payload); err != nil {
+		return err
+	}
+	slog.Info("send ROI request", "topic", topic, "crop", crop)
+	return nil
+}
+
+func (s *SignalingChannel) write(payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.c.WriteMessage(websocket.TextMessage, payload)
+}
+
+// Connect dials the sender.
+func (s *SignalingChannel) Connect() error {
 	u := url.URL{Scheme: "ws", Host: s.cfg.Addr, Path: "/webrtc"}
-	slog.Info("start spinning", "url", u.String())
+	slog.Info("dialing sender", "url", u.String())
 	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	s.c = c
-	defer c.Close()
+	slog.Info("dial success")
+	return nil
+}
+
+// Close ends the session, closing the websocket.
+func (s *SignalingChannel) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.c != nil {
+			s.c.Close()
+		}
+	})
+}
+
+// Done is closed once the session has ended.
+func (s *SignalingChannel) Done() <-chan struct{} {
+	return s.done
+}
+
+// Spin negotiates the peer connection over the websocket opened by Connect
+// and relays ICE candidates until the session ends.
+func (s *SignalingChannel) Spin() {
+	defer s.Close()
 	go func() {
+		defer s.Close()
 		for {
-			_, message, err := c.ReadMessage()
+			_, message, err := s.c.ReadMessage()
 			if err != nil {
 				slog.Error("recv error", "err", err)
 				return
 			}
-			s.recv <- message
+			if errMsg, ok := asErrorMessage(message); ok {
+				slog.Error("sender rejected request", "error", errMsg)
+				continue
+			}
+			select {
+			case s.recv <- message:
+			case <-s.done:
+				return
+			}
 		}
 	}()
-	slog.Info("dial success")
 
 	cfgMessage, err := toTextMessage(s.composeActions())
 	if err != nil {
 		slog.Error("compose message error", "error", err)
 		return
 	}
-	c.WriteMessage(websocket.TextMessage, cfgMessage)
+	if err := s.write(cfgMessage); err != nil {
+		slog.Error("failed to send configure message", "error", err)
+		return
+	}
 	slog.Info("send configure message")
-	recvRaw := <-s.recv
+	var recvRaw []byte
+	select {
+	case recvRaw = <-s.recv:
+	case <-s.done:
+		return
+	}
 	sdp := webrtc.SessionDescription{}
 	err = json.Unmarshal(recvRaw, &sdp)
 	if err != nil {
 		slog.Error("unmarshal error", "error", err)
 		return
 	}
-	s.sdpChan <- sdp
+	select {
+	case s.sdpChan <- sdp:
+	case <-s.done:
+		return
+	}
 	slog.Info("recv sdp")
-	answer := <-s.sdpReplyChan // await answer from peer connection
+	var answer webrtc.SessionDescription
+	select {
+	case answer = <-s.sdpReplyChan: // await answer from peer connection
+	case <-s.done:
+		return
+	}
 	// find "m=video 0 UDP/TLS/RTP/SAVPF 96 97 98 99 100 101" in SDP
 	// and turn it into "m=video 9 UDP/TLS/RTP/SAVPF 96 97 98 99 100 101"
-	answer.SDP = strings.Replace(answer.SDP, "m=video 0", "m=video 9", 1)
+	answer.SDP = strings.ReplaceAll(answer.SDP, "m=video 0", "m=video 9")
 	payload, err := json.Marshal(answer)
 	if err != nil {
 		slog.Error("marshal error", "error", err)
 	}
-	c.WriteMessage(websocket.TextMessage, payload)
+	if err := s.write(payload); err != nil {
+		slog.Error("failed to send answer", "error", err)
+		return
+	}
 	slog.Info("send answer")
+	s.answered.Store(true)
 	for {
-		candidateRaw := <-s.recv
+		var candidateRaw []byte
+		select {
+		case candidateRaw = <-s.recv:
+		case <-s.done:
+			return
+		}
 		candidateJSON := ICECandidateJSON{}
 		err := json.Unmarshal(candidateRaw, &candidateJSON)
 		if err != nil {
@@ -162,6 +280,23 @@ func (s *SignalingChannel) Spin() {
 			SDPMid:        &candidateJSON.SDPMid,
 			SDPMLineIndex: &candidateJSON.SDPMLineIndex,
 		}
-		s.candidateChan <- iceCandidate
+		select {
+		case s.candidateChan <- iceCandidate:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// asErrorMessage reports whether a message is an error sent back by the
+// sender, returning its description.
+func asErrorMessage(message []byte) (string, bool) {
+	errMsg := struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(message, &errMsg); err != nil || errMsg.Type != "error" {
+		return "", false
 	}
+	return errMsg.Message, true
 }
@@ -0,0 +1,29 @@
+package registry
+
+import (
+	"github.com/3DRX/webrtc-ros-bridge/consts"
+	geom_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/geometry_msgs/msg"
+	nav_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/nav_msgs/msg"
+	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+
+	// 导入Autoware消息类型
+	control_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/autoware_control_msgs/msg"
+	planning_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/autoware_planning_msgs/msg"
+	vehicle_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/autoware_vehicle_msgs/msg"
+)
+
+// the message types bridged out of the box, other generated types can be
+// added by importing their rclgo_gen package (see rclgo_gen_imports.go)
+func init() {
+	Register(consts.MSG_IMAGE, sensor_msgs_msg.ImageTypeSupport)
+	Register(consts.MSG_COMPRESSED_IMAGE, sensor_msgs_msg.CompressedImageTypeSupport)
+	Register(consts.MSG_LASER_SCAN, sensor_msgs_msg.LaserScanTypeSupport)
+	Register(consts.MSG_KINEMATIC, nav_msgs.OdometryTypeSupport)
+	Register(consts.MSG_POSE_COV, geom_msgs.PoseWithCovarianceStampedTypeSupport)
+	Register(consts.MSG_CONTROL_CMD, control_msgs.ControlTypeSupport)
+	Register(consts.MSG_TRAJECTORY, planning_msgs.TrajectoryTypeSupport)
+	Register(consts.MSG_CONTROL_MODE, vehicle_msgs.ControlModeReportTypeSupport)
+	Register(consts.MSG_VELOCITY, vehicle_msgs.VelocityReportTypeSupport)
+	Register(consts.MSG_STEERING, vehicle_msgs.SteeringReportTypeSupport)
+	Register(consts.MSG_GEAR, vehicle_msgs.GearReportTypeSupport)
+}
@@ -0,0 +1,80 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+	"github.com/tiiuae/rclgo/pkg/rclgo/types"
+)
+
+// SerializedCallback is called with every serialized message taken from a
+// subscription created by SubscribeSerialized.
+type SerializedCallback func(msg []byte, info *rclgo.MessageInfo, err error)
+
+var (
+	typeNameRe          = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*/msg/[A-Z][a-zA-Z0-9]*$`)
+	dynamicTypeSupports = make(map[string]types.MessageTypeSupport)
+)
+
+// IsValidTypeName reports whether msgType has the "pkg/msg/Type" form.
+func IsValidTypeName(msgType string) bool {
+	return typeNameRe.MatchString(msgType)
+}
+
+// LoadDynamic resolves the type support of msgType at runtime from the
+// typesupport library of its interface package. Messages of such types can
+// only be handled in serialized form.
+func LoadDynamic(msgType string) (types.MessageTypeSupport, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if ts, ok := dynamicTypeSupports[msgType]; ok {
+		return ts, nil
+	}
+	if !IsValidTypeName(msgType) {
+		return nil, fmt.Errorf("invalid message type: %s", msgType)
+	}
+	parts := strings.Split(msgType, "/")
+	ts, err := rclgo.LoadDynamicMessageTypeSupport(parts[0], parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", msgType, err)
+	}
+	dynamicTypeSupports[msgType] = ts
+	return ts, nil
+}
+
+// SubscribeSerialized creates a subscription of the dynamically loaded
+// msgType on topicName and calls callback with every message received,
+// without deserializing it.
+func SubscribeSerialized(
+	node *rclgo.Node,
+	topicName string,
+	msgType string,
+	opts *rclgo.SubscriptionOptions,
+	callback SerializedCallback,
+) (*rclgo.Subscription, error) {
+	ts, err := LoadDynamic(msgType)
+	if err != nil {
+		return nil, err
+	}
+	return node.NewSubscription(topicName, ts, opts, func(s *rclgo.Subscription) {
+		msg, info, err := s.TakeSerializedMessage()
+		callback(msg, info, err)
+	})
+}
+
+// NewDynamicPublisher creates a publisher of the dynamically loaded msgType
+// on topicName. Only Publisher.PublishSerialized can be used on it.
+func NewDynamicPublisher(
+	node *rclgo.Node,
+	topicName string,
+	msgType string,
+	opts *rclgo.PublisherOptions,
+) (*rclgo.Publisher, error) {
+	ts, err := LoadDynamic(msgType)
+	if err != nil {
+		return nil, err
+	}
+	return node.NewPublisher(topicName, ts, opts)
+}
@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+	"github.com/tiiuae/rclgo/pkg/rclgo/typemap"
+	"github.com/tiiuae/rclgo/pkg/rclgo/types"
+)
+
+// SubscriptionCallback is called with every message taken from a subscription
+// created by Subscribe.
+type SubscriptionCallback func(msg types.Message, info *rclgo.MessageInfo, err error)
+
+var (
+	mu           sync.RWMutex
+	typeSupports = make(map[string]types.MessageTypeSupport)
+)
+
+// Register makes msgType (e.g. "sensor_msgs/msg/Image") bridgeable using ts.
+func Register(msgType string, ts types.MessageTypeSupport) {
+	mu.Lock()
+	defer mu.Unlock()
+	typeSupports[msgType] = ts
+}
+
+// Lookup returns the type support of msgType. Types registered with Register
+// take precedence, otherwise every message package of rclgo_gen linked into
+// the binary is consulted.
+func Lookup(msgType string) (types.MessageTypeSupport, bool) {
+	mu.RLock()
+	ts, ok := typeSupports[msgType]
+	mu.RUnlock()
+	if ok {
+		return ts, true
+	}
+	return typemap.GetMessage(msgType)
+}
+
+func IsSupported(msgType string) bool {
+	_, ok := Lookup(msgType)
+	return ok
+}
+
+func mustLookup(msgType string) (types.MessageTypeSupport, error) {
+	ts, ok := Lookup(msgType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported message type: %s", msgType)
+	}
+	return ts, nil
+}
+
+// Subscribe creates a subscription of msgType on topicName and calls callback
+// with every message received.
+func Subscribe(
+	node *rclgo.Node,
+	topicName string,
+	msgType string,
+	opts *rclgo.SubscriptionOptions,
+	callback SubscriptionCallback,
+) (*rclgo.Subscription, error) {
+	ts, err := mustLookup(msgType)
+	if err != nil {
+		return nil, err
+	}
+	return node.NewSubscription(topicName, ts, opts, func(s *rclgo.Subscription) {
+		msg := ts.New()
+		info, err := s.TakeMessage(msg)
+		callback(msg, info, err)
+	})
+}
+
+// NewPublisher creates a publisher of msgType on topicName.
+func NewPublisher(
+	node *rclgo.Node,
+	topicName string,
+	msgType string,
+	opts *rclgo.PublisherOptions,
+) (*rclgo.Publisher, error) {
+	ts, err := mustLookup(msgType)
+	if err != nil {
+		return nil, err
+	}
+	return node.NewPublisher(topicName, ts, opts)
+}
@@ -0,0 +1,71 @@
+package rosmediadevicesadapter
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+
+	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+	"github.com/tiiuae/rclgo/pkg/rclgo/types"
+)
+
+// msgToI420 converts the crop part of an Image or CompressedImage message
+// to I420, the whole image when crop is empty.
+func msgToI420(msg types.Message, crop image.Rectangle, depth DepthMapping) (*image.YCbCr, error) {
+	switch msg := msg.(type) {
+	case *sensor_msgs_msg.Image:
+		return cropToI420(msg, crop, depth)
+	case *sensor_msgs_msg.CompressedImage:
+		return compressedToI420(msg, crop)
+	}
+	return nil, fmt.Errorf("unsupported message %T", msg)
+}
+
+// compressedToI420 decodes the JPEG or PNG image of msg and converts its crop
+// part to I420. The format of msg is only reported, the data tells the
+// format apart.
+func compressedToI420(msg *sensor_msgs_msg.CompressedImage, crop image.Rectangle) (*image.YCbCr, error) {
+	img, _, err := image.Decode(bytes.NewReader(msg.Data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %q image: %w", msg.Format, err)
+	}
+	crop = alignCrop(crop, img.Bounds())
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok && !crop.Empty() {
+		img = sub.SubImage(crop)
+	}
+	return decodedToI420(img), nil
+}
+
+// decodedToI420 converts a decoded image to an I420 image starting at the
+// origin. 4:2:0 JPEG images are used as they are, the luma plane of gray
+// images is shared rather than copied. Other images, e.g. PNG images with
+// transparency, are drawn onto black first.
+func decodedToI420(img image.Image) *image.YCbCr {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	switch img := img.(type) {
+	case *image.YCbCr:
+		if img.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+			// the planes of a sub image start at its corner already
+			yuv := *img
+			yuv.Rect = image.Rect(0, 0, width, height)
+			return &yuv
+		}
+	case *image.Gray:
+		return grayToI420(img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y):], img.Stride, width, height)
+	case *image.RGBA:
+		dst := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+		packedToI420(dst, img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y):], img.Stride, 4, [4]int{0, 1, 2, 3})
+		return dst
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(rgba, rgba.Rect, img, bounds.Min, draw.Src)
+	dst := image.NewYCbCr(rgba.Rect, image.YCbCrSubsampleRatio420)
+	packedToI420(dst, rgba.Pix, rgba.Stride, 4, [4]int{0, 1, 2, 3})
+	return dst
+}
@@ -0,0 +1,104 @@
+package rosmediadevicesadapter
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+)
+
+func TestCompressedToI420(t *testing.T) {
+	// the left half of each image is red, the right half white
+	encode := func(format string, img paintable) *sensor_msgs_msg.CompressedImage {
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 16; x++ {
+				c := color.Color(color.White)
+				if x < 8 {
+					c = color.RGBA{R: 255, A: 255}
+				}
+				img.Set(x, y, c)
+			}
+		}
+		buf := bytes.Buffer{}
+		var err error
+		if format == "jpeg" {
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100})
+		} else {
+			err = png.Encode(&buf, img)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &sensor_msgs_msg.CompressedImage{Format: format, Data: buf.Bytes()}
+	}
+	red := color.YCbCr{Y: 76, Cb: 85, Cr: 255}
+	white := color.YCbCr{Y: 255, Cb: 128, Cr: 128}
+	gray := color.YCbCr{Y: 76, Cb: 128, Cr: 128}
+	black := color.YCbCr{Y: 0, Cb: 128, Cr: 128}
+	tests := []struct {
+		name      string
+		msg       *sensor_msgs_msg.CompressedImage
+		crop      image.Rectangle
+		size      image.Point
+		left      color.YCbCr // expected at (0, 0)
+		right     color.YCbCr // expected at the top right corner
+		tolerance int
+	}{
+		{"jpeg", encode("jpeg", image.NewRGBA(image.Rect(0, 0, 16, 16))), image.Rectangle{}, image.Pt(16, 16), red, white, 4},
+		{"png", encode("png", image.NewNRGBA(image.Rect(0, 0, 16, 16))), image.Rectangle{}, image.Pt(16, 16), red, white, 0},
+		{"transparent png", encode("png", transparent{image.NewNRGBA(image.Rect(0, 0, 16, 16))}), image.Rectangle{}, image.Pt(16, 16), black, black, 0},
+		{"gray png", encode("png", image.NewGray(image.Rect(0, 0, 16, 16))), image.Rectangle{}, image.Pt(16, 16), gray, white, 0},
+		{"paletted png", encode("png", image.NewPaletted(image.Rect(0, 0, 16, 16), color.Palette{color.White, color.RGBA{R: 255, A: 255}})), image.Rectangle{}, image.Pt(16, 16), red, white, 0},
+		{"cropped jpeg", encode("jpeg", image.NewRGBA(image.Rect(0, 0, 16, 16))), image.Rect(10, 4, 14, 8), image.Pt(4, 4), white, white, 4},
+		{"cropped png", encode("png", image.NewNRGBA(image.Rect(0, 0, 16, 16))), image.Rect(6, 4, 10, 8), image.Pt(4, 4), red, white, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yuv, err := compressedToI420(tt.msg, tt.crop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if yuv.SubsampleRatio != image.YCbCrSubsampleRatio420 || yuv.Rect != (image.Rectangle{Max: tt.size}) {
+				t.Fatalf("%v %v image, expected I420 of %v", yuv.SubsampleRatio, yuv.Rect, tt.size)
+			}
+			for _, p := range []struct {
+				at   image.Point
+				want color.YCbCr
+			}{{image.Pt(0, 0), tt.left}, {image.Pt(tt.size.X-1, 0), tt.right}} {
+				got := yuv.YCbCrAt(p.at.X, p.at.Y)
+				if !closeTo(got.Y, p.want.Y, tt.tolerance) || !closeTo(got.Cb, p.want.Cb, tt.tolerance) || !closeTo(got.Cr, p.want.Cr, tt.tolerance) {
+					t.Errorf("pixel %v = %v, expected %v", p.at, got, p.want)
+				}
+			}
+		})
+	}
+	if _, err := compressedToI420(&sensor_msgs_msg.CompressedImage{Format: "jpeg", Data: []byte{0}}, image.Rectangle{}); err == nil {
+		t.Error("expected an error for invalid data")
+	}
+}
+
+// paintable is an image the test can paint.
+type paintable interface {
+	image.Image
+	Set(x, y int, c color.Color)
+}
+
+// transparent paints fully transparent pixels of the color set.
+type transparent struct {
+	*image.NRGBA
+}
+
+func (img transparent) Set(x, y int, c color.Color) {
+	nrgba := color.NRGBAModel.Convert(c).(color.NRGBA)
+	nrgba.A = 0
+	img.SetNRGBA(x, y, nrgba)
+}
+
+func closeTo(got, want uint8, tolerance int) bool {
+	d := int(got) - int(want)
+	return d >= -tolerance && d <= tolerance
+}
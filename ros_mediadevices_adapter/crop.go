@@ -0,0 +1,86 @@
+package rosmediadevicesadapter
+
+import (
+	"image"
+
+	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+)
+
+// cropToI420 converts the crop part of rosImg to I420, the whole image when
+// crop is empty. Images whose rows store pixels next to each other are
+// cropped before the conversion, so only the crop is converted.
+func cropToI420(rosImg *sensor_msgs_msg.Image, crop image.Rectangle, depth DepthMapping) (*image.YCbCr, error) {
+	crop = alignCrop(crop, image.Rect(0, 0, int(rosImg.Width), int(rosImg.Height)))
+	if crop.Empty() {
+		return ROSImageToI420(rosImg, depth)
+	}
+	if cropped, ok := cropROSImage(rosImg, crop); ok {
+		return ROSImageToI420(cropped, depth)
+	}
+	yuv, err := ROSImageToI420(rosImg, depth)
+	if err != nil {
+		return nil, err
+	}
+	sub := yuv.SubImage(crop).(*image.YCbCr)
+	// the planes of sub start at the crop already
+	sub.Rect = image.Rect(0, 0, crop.Dx(), crop.Dy())
+	return sub, nil
+}
+
+// alignCrop clips crop to bounds, moving its corner to even coordinates so
+// that it covers whole chroma samples and bayer patterns. The result is
+// empty when crop is empty or covers the whole image.
+func alignCrop(crop image.Rectangle, bounds image.Rectangle) image.Rectangle {
+	crop = crop.Intersect(bounds)
+	crop.Min.X &^= 1
+	crop.Min.Y &^= 1
+	if crop == bounds {
+		return image.Rectangle{}
+	}
+	return crop
+}
+
+// cropROSImage returns the crop part of rosImg, sharing its data, or false
+// for planar encodings.
+func cropROSImage(rosImg *sensor_msgs_msg.Image, crop image.Rectangle) (*sensor_msgs_msg.Image, bool) {
+	pixelSize, ok := pixelSizeOf(rosImg.Encoding)
+	if !ok {
+		return nil, false
+	}
+	stride := int(rosImg.Step)
+	if stride == 0 {
+		stride = int(rosImg.Width) * pixelSize
+	}
+	offset := crop.Min.Y*stride + crop.Min.X*pixelSize
+	if offset > len(rosImg.Data) {
+		return nil, false
+	}
+	cropped := *rosImg
+	cropped.Width = uint32(crop.Dx())
+	cropped.Height = uint32(crop.Dy())
+	cropped.Step = uint32(stride)
+	cropped.Data = rosImg.Data[offset:]
+	return &cropped, true
+}
+
+// pixelSizeOf returns the bytes per pixel of encodings storing the pixels of
+// each row next to each other, two for the pixel pairs of yuv422.
+func pixelSizeOf(encoding string) (int, bool) {
+	if layout, ok := packedLayouts[encoding]; ok {
+		return layout.channels * sampleSizes[layout.depth], true
+	}
+	if m := typeEncodingRegexp.FindStringSubmatch(encoding); m != nil {
+		return int(m[2][0]-'0') * sampleSizes[m[1]], true
+	}
+	if m := bayerEncodingRegexp.FindStringSubmatch(encoding); m != nil {
+		if m[2] == "16" {
+			return 2, true
+		}
+		return 1, true
+	}
+	switch encoding {
+	case "yuv422", "uyvy", "yuv422_yuy2", "yuyv":
+		return 2, true
+	}
+	return 0, false
+}
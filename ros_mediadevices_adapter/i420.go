@@ -0,0 +1,232 @@
+package rosmediadevicesadapter
+
+import (
+	"fmt"
+	"image"
+	"runtime"
+	"sync"
+
+	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+)
+
+// parallelMinPixels is the image size from which conversions are split
+// between goroutines, below it the overhead outweighs the gain.
+const parallelMinPixels = 640 * 480
+
+// ROSImageToI420 converts an image to the I420 frames the encoders take.
+// rgb8, bgr8, rgba8, bgra8, mono8, yuv422, yuv422_yuy2, nv12 and nv21 images
+// are converted in a single pass, the luma plane of mono8, nv12 and nv21
+// images is shared with rosImg rather than copied. Other encodings go
+// through ROSImageToRGBAWithDepth first.
+func ROSImageToI420(rosImg *sensor_msgs_msg.Image, depth DepthMapping) (*image.YCbCr, error) {
+	width, height := int(rosImg.Width), int(rosImg.Height)
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("empty %dx%d image", width, height)
+	}
+	switch rosImg.Encoding {
+	case "rgb8", "bgr8", "rgba8", "bgra8":
+		layout := packedLayouts[rosImg.Encoding]
+		stride, err := rowStride(rosImg, width*layout.channels, height)
+		if err != nil {
+			return nil, err
+		}
+		dst := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+		packedToI420(dst, rosImg.Data, stride, layout.channels, layout.rgba)
+		return dst, nil
+	case "mono8":
+		stride, err := rowStride(rosImg, width, height)
+		if err != nil {
+			return nil, err
+		}
+		return grayToI420(rosImg.Data, stride, width, height), nil
+	case "yuv422", "uyvy":
+		return yuv422ToI420(rosImg, 1, 0, 2)
+	case "yuv422_yuy2", "yuyv":
+		return yuv422ToI420(rosImg, 0, 1, 3)
+	case "nv12":
+		return nvToI420(rosImg, 0)
+	case "nv21":
+		return nvToI420(rosImg, 1)
+	}
+	rgba, err := ROSImageToRGBAWithDepth(rosImg, depth)
+	if err != nil {
+		return nil, err
+	}
+	dst := image.NewYCbCr(rgba.Rect, image.YCbCrSubsampleRatio420)
+	packedToI420(dst, rgba.Pix, rgba.Stride, 4, [4]int{0, 1, 2, 3})
+	return dst, nil
+}
+
+// newI420Chroma creates an I420 image around the luma plane y, allocating
+// its chroma planes only.
+func newI420Chroma(y []byte, yStride, width, height int) *image.YCbCr {
+	cw, ch := (width+1)/2, (height+1)/2
+	chroma := make([]byte, 2*cw*ch)
+	return &image.YCbCr{
+		Y:              y,
+		Cb:             chroma[:cw*ch],
+		Cr:             chroma[cw*ch:],
+		YStride:        yStride,
+		CStride:        cw,
+		SubsampleRatio: image.YCbCrSubsampleRatio420,
+		Rect:           image.Rect(0, 0, width, height),
+	}
+}
+
+// grayToI420 creates a colorless I420 image around the luma plane y.
+func grayToI420(y []byte, yStride, width, height int) *image.YCbCr {
+	dst := newI420Chroma(y, yStride, width, height)
+	for i := range dst.Cb {
+		dst.Cb[i] = 128
+		dst.Cr[i] = 128
+	}
+	return dst
+}
+
+// forEachRowPair calls convert on ranges of rows starting at even rows, so
+// that each range covers whole chroma rows, from several goroutines for
+// large images.
+func forEachRowPair(width, height int, convert func(y0, y1 int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if width*height < parallelMinPixels || workers == 1 {
+		convert(0, height)
+		return
+	}
+	pairs := (height + 1) / 2
+	rows := (pairs + workers - 1) / workers * 2
+	var wg sync.WaitGroup
+	for y0 := 0; y0 < height; y0 += rows {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			convert(y0, y1)
+		}(y0, min(y0+rows, height))
+	}
+	wg.Wait()
+}
+
+// the full range BT.601 conversion of image/color.RGBToYCbCr, inlined
+func luma(r, g, b int32) uint8 {
+	return uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 16)
+}
+
+func chroma(r, g, b int32) (uint8, uint8) {
+	cb := -11056*r - 21712*g + 32768*b + 257<<15
+	cr := 32768*r - 27440*g - 5328*b + 257<<15
+	return clampChroma(cb), clampChroma(cr)
+}
+
+func clampChroma(c int32) uint8 {
+	if uint32(c)&0xff000000 == 0 {
+		return uint8(c >> 16)
+	}
+	return uint8(^(c >> 31))
+}
+
+// packedToI420 converts 8 bit pixels of pixelSize bytes, whose red, green
+// and blue are at the first three offsets of rgba, to dst. The chroma of each
+// 2x2 block is the one of its average color.
+func packedToI420(dst *image.YCbCr, data []byte, stride, pixelSize int, rgba [4]int) {
+	width, height := dst.Rect.Dx(), dst.Rect.Dy()
+	ro, gro, bo := rgba[0], rgba[1], rgba[2]
+	forEachRowPair(width, height, func(y0, y1 int) {
+		for y := y0; y < y1; y += 2 {
+			rows := min(2, height-y)
+			c := (y / 2) * dst.CStride
+			x := 0
+			if rows == 2 {
+				// whole 2x2 blocks, the hot loop
+				top, bottom := data[y*stride:], data[(y+1)*stride:]
+				lumTop, lumBottom := dst.Y[y*dst.YStride:], dst.Y[(y+1)*dst.YStride:]
+				cb, cr := dst.Cb[c:], dst.Cr[c:]
+				for ; x+1 < width; x += 2 {
+					p0, p1 := top[x*pixelSize:], top[(x+1)*pixelSize:]
+					p2, p3 := bottom[x*pixelSize:], bottom[(x+1)*pixelSize:]
+					r0, g0, b0 := int32(p0[ro]), int32(p0[gro]), int32(p0[bo])
+					r1, g1, b1 := int32(p1[ro]), int32(p1[gro]), int32(p1[bo])
+					r2, g2, b2 := int32(p2[ro]), int32(p2[gro]), int32(p2[bo])
+					r3, g3, b3 := int32(p3[ro]), int32(p3[gro]), int32(p3[bo])
+					lumTop[x], lumTop[x+1] = luma(r0, g0, b0), luma(r1, g1, b1)
+					lumBottom[x], lumBottom[x+1] = luma(r2, g2, b2), luma(r3, g3, b3)
+					cb[x/2], cr[x/2] = chroma((r0+r1+r2+r3+2)>>2, (g0+g1+g2+g3+2)>>2, (b0+b1+b2+b3+2)>>2)
+				}
+			}
+			for ; x < width; x += 2 {
+				cols := min(2, width-x)
+				var rs, gs, bs int32
+				for dy := 0; dy < rows; dy++ {
+					src := data[(y+dy)*stride+x*pixelSize:]
+					lum := dst.Y[(y+dy)*dst.YStride+x:]
+					for dx := 0; dx < cols; dx++ {
+						p := src[dx*pixelSize:]
+						r, g, b := int32(p[ro]), int32(p[gro]), int32(p[bo])
+						lum[dx] = luma(r, g, b)
+						rs, gs, bs = rs+r, gs+g, bs+b
+					}
+				}
+				n := int32(rows * cols)
+				dst.Cb[c+x/2], dst.Cr[c+x/2] = chroma((rs+n/2)/n, (gs+n/2)/n, (bs+n/2)/n)
+			}
+		}
+	})
+}
+
+// yuv422ToI420 converts packed 4:2:2 images given the offsets of the first
+// luma, blue and red difference bytes of each 4 byte pair of pixels,
+// averaging the chroma of two rows.
+func yuv422ToI420(rosImg *sensor_msgs_msg.Image, y0, u, v int) (*image.YCbCr, error) {
+	width, height := int(rosImg.Width), int(rosImg.Height)
+	stride, err := rowStride(rosImg, (width+1)/2*4, height)
+	if err != nil {
+		return nil, err
+	}
+	dst := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	forEachRowPair(width, height, func(r0, r1 int) {
+		for y := r0; y < r1; y += 2 {
+			next := y + 1
+			if next >= height {
+				next = y
+			}
+			row := rosImg.Data[y*stride:]
+			nextRow := rosImg.Data[next*stride:]
+			lum := dst.Y[y*dst.YStride:]
+			nextLum := dst.Y[next*dst.YStride:]
+			c := (y / 2) * dst.CStride
+			for x := 0; x < width; x += 2 {
+				p, q := row[x*2:], nextRow[x*2:]
+				lum[x], nextLum[x] = p[y0], q[y0]
+				if x+1 < width {
+					lum[x+1], nextLum[x+1] = p[y0+2], q[y0+2]
+				}
+				dst.Cb[c+x/2] = uint8((uint16(p[u]) + uint16(q[u]) + 1) / 2)
+				dst.Cr[c+x/2] = uint8((uint16(p[v]) + uint16(q[v]) + 1) / 2)
+			}
+		}
+	})
+	return dst, nil
+}
+
+// nvToI420 converts nv12 (u 0) and nv21 (u 1) images, sharing their luma
+// plane and splitting the interleaved chroma plane.
+func nvToI420(rosImg *sensor_msgs_msg.Image, u int) (*image.YCbCr, error) {
+	width, height := int(rosImg.Width), int(rosImg.Height)
+	v := 1 - u
+	stride, err := rowStride(rosImg, width, height)
+	if err != nil {
+		return nil, err
+	}
+	cw, ch := (width+1)/2, (height+1)/2
+	plane := height * stride
+	if need := plane + (ch-1)*stride + cw*2; len(rosImg.Data) < need {
+		return nil, fmt.Errorf("%s image needs %d bytes, got %d", rosImg.Encoding, need, len(rosImg.Data))
+	}
+	dst := newI420Chroma(rosImg.Data, stride, width, height)
+	for y := 0; y < ch; y++ {
+		pairs := rosImg.Data[plane+y*stride:]
+		cb, cr := dst.Cb[y*cw:(y+1)*cw], dst.Cr[y*cw:(y+1)*cw]
+		for x := range cb {
+			cb[x], cr[x] = pairs[2*x+u], pairs[2*x+v]
+		}
+	}
+	return dst, nil
+}
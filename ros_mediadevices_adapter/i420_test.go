@@ -0,0 +1,98 @@
+package rosmediadevicesadapter
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+
+	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+)
+
+// solidImage returns a width x height image of encoding repeating pixel,
+// with rows padded by one byte.
+func solidImage(encoding string, width, height int, pixel []byte, pixelsPerUnit int) *sensor_msgs_msg.Image {
+	row := bytes.Repeat(pixel, (width+pixelsPerUnit-1)/pixelsPerUnit)
+	step := len(row) + 1
+	data := make([]byte, 0, step*height)
+	for y := 0; y < height; y++ {
+		data = append(append(data, row...), 0)
+	}
+	return &sensor_msgs_msg.Image{
+		Width:    uint32(width),
+		Height:   uint32(height),
+		Step:     uint32(step),
+		Encoding: encoding,
+		Data:     data,
+	}
+}
+
+func TestROSImageToI420(t *testing.T) {
+	y, cb, cr := color.RGBToYCbCr(200, 100, 50)
+	nv12 := solidImage("nv12", 5, 3, []byte{y}, 1)
+	for i := 0; i < 2; i++ {
+		nv12.Data = append(nv12.Data, bytes.Repeat([]byte{cb, cr}, 3)...)
+	}
+	tests := []struct {
+		name     string
+		img      *sensor_msgs_msg.Image
+		expected color.YCbCr
+	}{
+		{"rgb8", solidImage("rgb8", 5, 3, []byte{200, 100, 50}, 1), color.YCbCr{y, cb, cr}},
+		{"bgra8", solidImage("bgra8", 5, 3, []byte{50, 100, 200, 255}, 1), color.YCbCr{y, cb, cr}},
+		{"mono8", solidImage("mono8", 5, 3, []byte{77}, 1), color.YCbCr{77, 128, 128}},
+		{"yuv422", solidImage("yuv422", 5, 3, []byte{cb, y, cr, y}, 2), color.YCbCr{y, cb, cr}},
+		{"yuv422_yuy2", solidImage("yuv422_yuy2", 5, 3, []byte{y, cb, y, cr}, 2), color.YCbCr{y, cb, cr}},
+		{"nv12", nv12, color.YCbCr{y, cb, cr}},
+		{"rgb16 through rgba", solidImage("rgb16", 5, 3, []byte{0, 200, 0, 100, 0, 50}, 1), color.YCbCr{y, cb, cr}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yuv, err := ROSImageToI420(tt.img, DepthMapping{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for py := 0; py < int(tt.img.Height); py++ {
+				for px := 0; px < int(tt.img.Width); px++ {
+					if got := yuv.YCbCrAt(px, py); got != tt.expected {
+						t.Fatalf("pixel (%d, %d) = %v, expected %v", px, py, got, tt.expected)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestROSImageToI420SharesLuma(t *testing.T) {
+	img := solidImage("mono8", 4, 2, []byte{10}, 1)
+	yuv, err := ROSImageToI420(img, DepthMapping{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &yuv.Y[0] != &img.Data[0] {
+		t.Error("expected the luma plane to be shared with the image")
+	}
+}
+
+func benchmarkROSImageToI420(b *testing.B, encoding string, pixel []byte, pixelsPerUnit int) {
+	img := solidImage(encoding, 1920, 1080, pixel, pixelsPerUnit)
+	if encoding == "nv12" {
+		img.Data = append(img.Data, make([]byte, 540*int(img.Step))...)
+	}
+	b.SetBytes(int64(len(img.Data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ROSImageToI420(img, DepthMapping{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// frames per second a single stream could convert, 30 is needed for 1080p30
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "frames/s")
+}
+
+func BenchmarkROSImageToI420(b *testing.B) {
+	b.Run("rgb8", func(b *testing.B) { benchmarkROSImageToI420(b, "rgb8", []byte{200, 100, 50}, 1) })
+	b.Run("bgra8", func(b *testing.B) { benchmarkROSImageToI420(b, "bgra8", []byte{50, 100, 200, 255}, 1) })
+	b.Run("yuv422", func(b *testing.B) { benchmarkROSImageToI420(b, "yuv422", []byte{128, 90, 128, 90}, 2) })
+	b.Run("nv12", func(b *testing.B) { benchmarkROSImageToI420(b, "nv12", []byte{90}, 1) })
+	b.Run("16UC1", func(b *testing.B) { benchmarkROSImageToI420(b, "16UC1", []byte{0xe8, 0x03}, 1) })
+}
@@ -0,0 +1,362 @@
+package rosmediadevicesadapter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"regexp"
+	"strconv"
+
+	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+)
+
+const (
+	ColormapGray = "gray"
+	ColormapJet  = "jet"
+)
+
+// DepthMapping maps the values of single channel images, such as 16UC1 or
+// 32FC1 depth images, to colors.
+type DepthMapping struct {
+	Min      float64 // value mapped to the start of the colormap
+	Max      float64 // value mapped to the end of the colormap, Min == Max uses the range of each frame
+	Colormap string  // "gray" (default) or "jet"
+}
+
+// packedLayout describes an encoding storing the channels of each pixel
+// next to each other.
+type packedLayout struct {
+	channels int
+	depth    string // channel type, as in the TYPE_* encodings
+	rgba     [4]int // channel of red, green, blue and alpha, -1 for none
+}
+
+// see sensor_msgs/image_encodings.hpp
+var packedLayouts = map[string]packedLayout{
+	"rgb8":   {3, "8U", [4]int{0, 1, 2, -1}},
+	"rgba8":  {4, "8U", [4]int{0, 1, 2, 3}},
+	"rgb16":  {3, "16U", [4]int{0, 1, 2, -1}},
+	"rgba16": {4, "16U", [4]int{0, 1, 2, 3}},
+	"bgr8":   {3, "8U", [4]int{2, 1, 0, -1}},
+	"bgra8":  {4, "8U", [4]int{2, 1, 0, 3}},
+	"bgr16":  {3, "16U", [4]int{2, 1, 0, -1}},
+	"bgra16": {4, "16U", [4]int{2, 1, 0, 3}},
+	"mono8":  {1, "8U", [4]int{0, 0, 0, -1}},
+	"mono16": {1, "16U", [4]int{0, 0, 0, -1}},
+}
+
+// bayerPatterns gives the color (0 red, 1 green, 2 blue) of the top left
+// 2x2 pixels of each bayer encoding, row by row.
+var bayerPatterns = map[string][4]int{
+	"rggb": {0, 1, 1, 2},
+	"bggr": {2, 1, 1, 0},
+	"gbrg": {1, 2, 0, 1},
+	"grbg": {1, 0, 2, 1},
+}
+
+var (
+	typeEncodingRegexp  = regexp.MustCompile(`^(8U|8S|16U|16S|32S|32F|64F)C([1-4])$`)
+	bayerEncodingRegexp = regexp.MustCompile(`^bayer_(rggb|bggr|gbrg|grbg)(8|16)$`)
+)
+
+var sampleSizes = map[string]int{"8U": 1, "8S": 1, "16U": 2, "16S": 2, "32S": 4, "32F": 4, "64F": 8}
+
+func ROSImageToRGBA(rosImg *sensor_msgs_msg.Image) (*image.RGBA, error) {
+	return ROSImageToRGBAWithDepth(rosImg, DepthMapping{})
+}
+
+// ROSImageToRGBAWithDepth converts an image of any sensor_msgs encoding,
+// mapping single channel images other than mono8 and mono16 to colors with
+// depth.
+func ROSImageToRGBAWithDepth(rosImg *sensor_msgs_msg.Image, depth DepthMapping) (*image.RGBA, error) {
+	width := int(rosImg.Width)
+	height := int(rosImg.Height)
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("empty %dx%d image", width, height)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if rosImg.IsBigendian != 0 {
+		order = binary.BigEndian
+	}
+	enc := rosImg.Encoding
+	if layout, ok := packedLayouts[enc]; ok {
+		return convertPacked(rosImg, layout, order)
+	}
+	if m := typeEncodingRegexp.FindStringSubmatch(enc); m != nil {
+		channels, _ := strconv.Atoi(m[2])
+		switch channels {
+		case 1, 2:
+			// the first channel only, e.g. depth or disparity
+			return convertMapped(rosImg, m[1], channels, order, depth)
+		case 3:
+			// OpenCV stores colors as BGR
+			return convertPacked(rosImg, packedLayout{3, m[1], [4]int{2, 1, 0, -1}}, order)
+		default:
+			return convertPacked(rosImg, packedLayout{4, m[1], [4]int{2, 1, 0, 3}}, order)
+		}
+	}
+	if m := bayerEncodingRegexp.FindStringSubmatch(enc); m != nil {
+		sampleDepth := "8U"
+		if m[2] == "16" {
+			sampleDepth = "16U"
+		}
+		return convertBayer(rosImg, bayerPatterns[m[1]], sampleDepth, order)
+	}
+	switch enc {
+	case "yuv422", "uyvy":
+		return convertYUV422(rosImg, 1, 0, 2)
+	case "yuv422_yuy2", "yuyv":
+		return convertYUV422(rosImg, 0, 1, 3)
+	case "nv12":
+		return convertNV(rosImg, 2, 0)
+	case "nv21":
+		return convertNV(rosImg, 2, 1)
+	case "nv24":
+		return convertNV(rosImg, 1, 0)
+	}
+	return nil, fmt.Errorf("unsupported image encoding: %s", enc)
+}
+
+// rowStride returns the step of the image, or rowBytes if the publisher left
+// it unset, and checks that data holds rows of that stride.
+func rowStride(rosImg *sensor_msgs_msg.Image, rowBytes int, rows int) (int, error) {
+	stride := int(rosImg.Step)
+	if stride == 0 {
+		stride = rowBytes
+	}
+	if stride < rowBytes {
+		return 0, fmt.Errorf("step %d of %s image shorter than a row of %d bytes", stride, rosImg.Encoding, rowBytes)
+	}
+	if need := (rows-1)*stride + rowBytes; len(rosImg.Data) < need {
+		return 0, fmt.Errorf("%s image needs %d bytes, got %d", rosImg.Encoding, need, len(rosImg.Data))
+	}
+	return stride, nil
+}
+
+// readSample reads one channel value of type depth.
+func readSample(data []byte, depth string, order binary.ByteOrder) float64 {
+	switch depth {
+	case "8U":
+		return float64(data[0])
+	case "8S":
+		return float64(int8(data[0]))
+	case "16U":
+		return float64(order.Uint16(data))
+	case "16S":
+		return float64(int16(order.Uint16(data)))
+	case "32S":
+		return float64(int32(order.Uint32(data)))
+	case "32F":
+		return float64(math.Float32frombits(order.Uint32(data)))
+	default:
+		return math.Float64frombits(order.Uint64(data))
+	}
+}
+
+// to8Bit scales a channel value of type depth to 8 bits: integers by their
+// range, floats from [0, 1].
+func to8Bit(v float64, depth string) uint8 {
+	switch depth {
+	case "8U":
+		return uint8(v)
+	case "8S":
+		return uint8(v + 128)
+	case "16U":
+		return uint8(uint16(v) >> 8)
+	case "16S":
+		return uint8((int32(v) + 32768) >> 8)
+	case "32S":
+		return uint8((int64(v) + 1<<31) >> 24)
+	}
+	if math.IsNaN(v) {
+		return 0
+	}
+	return uint8(math.Round(min(max(v, 0), 1) * 255))
+}
+
+func convertPacked(rosImg *sensor_msgs_msg.Image, layout packedLayout, order binary.ByteOrder) (*image.RGBA, error) {
+	width, height := int(rosImg.Width), int(rosImg.Height)
+	sampleSize := sampleSizes[layout.depth]
+	pixelSize := layout.channels * sampleSize
+	stride, err := rowStride(rosImg, width*pixelSize, height)
+	if err != nil {
+		return nil, err
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := rosImg.Data[y*stride:]
+		for x := 0; x < width; x++ {
+			pixel := row[x*pixelSize:]
+			dst := rgba.Pix[y*rgba.Stride+x*4:]
+			for i, channel := range layout.rgba {
+				if channel < 0 {
+					dst[i] = 255
+					continue
+				}
+				dst[i] = to8Bit(readSample(pixel[channel*sampleSize:], layout.depth, order), layout.depth)
+			}
+		}
+	}
+	return rgba, nil
+}
+
+// convertMapped maps the first channel of each pixel through depth.
+func convertMapped(rosImg *sensor_msgs_msg.Image, sampleDepth string, channels int, order binary.ByteOrder, depth DepthMapping) (*image.RGBA, error) {
+	width, height := int(rosImg.Width), int(rosImg.Height)
+	sampleSize := sampleSizes[sampleDepth]
+	pixelSize := channels * sampleSize
+	stride, err := rowStride(rosImg, width*pixelSize, height)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]float64, width*height)
+	lo, hi := depth.Min, depth.Max
+	autoRange := lo == hi
+	if autoRange {
+		lo, hi = math.Inf(1), math.Inf(-1)
+	}
+	for y := 0; y < height; y++ {
+		row := rosImg.Data[y*stride:]
+		for x := 0; x < width; x++ {
+			v := readSample(row[x*pixelSize:], sampleDepth, order)
+			values[y*width+x] = v
+			if autoRange && !math.IsNaN(v) && !math.IsInf(v, 0) {
+				lo = min(lo, v)
+				hi = max(hi, v)
+			}
+		}
+	}
+	var palette [256]color.RGBA
+	for i := range palette {
+		palette[i] = colormap(float64(i)/255, depth.Colormap)
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, v := range values {
+		c := color.RGBA{A: 255}
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			t := 0.0
+			if hi > lo {
+				t = min(max((v-lo)/(hi-lo), 0), 1)
+			}
+			c = palette[uint8(t*255+0.5)]
+		}
+		// rgba.Stride is width*4
+		dst := rgba.Pix[i*4:]
+		dst[0], dst[1], dst[2], dst[3] = c.R, c.G, c.B, c.A
+	}
+	return rgba, nil
+}
+
+// colormap returns the color of t in [0, 1].
+func colormap(t float64, name string) color.RGBA {
+	if name == ColormapJet {
+		channel := func(offset float64) uint8 {
+			return uint8(math.Round(min(max(1.5-math.Abs(4*t-offset), 0), 1) * 255))
+		}
+		return color.RGBA{R: channel(3), G: channel(2), B: channel(1), A: 255}
+	}
+	g := uint8(math.Round(t * 255))
+	return color.RGBA{R: g, G: g, B: g, A: 255}
+}
+
+// convertBayer demosaics a bayer image by bilinear interpolation: each
+// missing color of a pixel is the average of its neighbours of that color.
+func convertBayer(rosImg *sensor_msgs_msg.Image, pattern [4]int, sampleDepth string, order binary.ByteOrder) (*image.RGBA, error) {
+	width, height := int(rosImg.Width), int(rosImg.Height)
+	sampleSize := sampleSizes[sampleDepth]
+	stride, err := rowStride(rosImg, width*sampleSize, height)
+	if err != nil {
+		return nil, err
+	}
+	at := func(x, y int) uint8 {
+		return to8Bit(readSample(rosImg.Data[y*stride+x*sampleSize:], sampleDepth, order), sampleDepth)
+	}
+	colorAt := func(x, y int) int {
+		return pattern[(y%2)*2+x%2]
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sums, counts [3]int
+			own := colorAt(x, y)
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					nx, ny := x+dx, y+dy
+					if nx < 0 || ny < 0 || nx >= width || ny >= height {
+						continue
+					}
+					c := colorAt(nx, ny)
+					if c == own && (dx != 0 || dy != 0) {
+						continue
+					}
+					sums[c] += int(at(nx, ny))
+					counts[c]++
+				}
+			}
+			dst := rgba.Pix[y*rgba.Stride+x*4:]
+			for c := 0; c < 3; c++ {
+				if counts[c] > 0 {
+					dst[c] = uint8(sums[c] / counts[c])
+				}
+			}
+			dst[3] = 255
+		}
+	}
+	return rgba, nil
+}
+
+// convertYUV422 converts packed 4:2:2 images, where every 4 bytes hold two
+// pixels, given the offsets of the first luma, blue and red difference bytes.
+func convertYUV422(rosImg *sensor_msgs_msg.Image, y0, u, v int) (*image.RGBA, error) {
+	width, height := int(rosImg.Width), int(rosImg.Height)
+	stride, err := rowStride(rosImg, (width+1)/2*4, height)
+	if err != nil {
+		return nil, err
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := rosImg.Data[y*stride:]
+		for x := 0; x < width; x++ {
+			pair := row[x/2*4:]
+			r, g, b := color.YCbCrToRGB(pair[y0+x%2*2], pair[u], pair[v])
+			dst := rgba.Pix[y*rgba.Stride+x*4:]
+			dst[0], dst[1], dst[2], dst[3] = r, g, b, 255
+		}
+	}
+	return rgba, nil
+}
+
+// convertNV converts semi-planar images: a luma plane followed by a plane of
+// interleaved chroma pairs, subsampled by 2 in both directions with
+// subsampling 2 (nv12, nv21) or not at all with subsampling 1 (nv24). u and v are
+// the offsets of the chroma bytes in each pair.
+func convertNV(rosImg *sensor_msgs_msg.Image, subsampling int, u int) (*image.RGBA, error) {
+	width, height := int(rosImg.Width), int(rosImg.Height)
+	v := 1 - u
+	chromaWidth := (width + subsampling - 1) / subsampling
+	chromaHeight := (height + subsampling - 1) / subsampling
+	// the chroma rows have as many bytes per pair as the luma rows per pixel
+	stride, err := rowStride(rosImg, width, height)
+	if err != nil {
+		return nil, err
+	}
+	chromaStride := stride * 2 / subsampling
+	chroma := height * stride
+	if need := chroma + (chromaHeight-1)*chromaStride + chromaWidth*2; len(rosImg.Data) < need {
+		return nil, fmt.Errorf("%s image needs %d bytes, got %d", rosImg.Encoding, need, len(rosImg.Data))
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		luma := rosImg.Data[y*stride:]
+		chromaRow := rosImg.Data[chroma+(y/subsampling)*chromaStride:]
+		for x := 0; x < width; x++ {
+			pair := chromaRow[(x/subsampling)*2:]
+			r, g, b := color.YCbCrToRGB(luma[x], pair[u], pair[v])
+			dst := rgba.Pix[y*rgba.Stride+x*4:]
+			dst[0], dst[1], dst[2], dst[3] = r, g, b, 255
+		}
+	}
+	return rgba, nil
+}
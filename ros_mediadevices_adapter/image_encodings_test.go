@@ -0,0 +1,122 @@
+package rosmediadevicesadapter
+
+import (
+	"encoding/binary"
+	"image/color"
+	"math"
+	"testing"
+
+	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+)
+
+func float32Bytes(values ...float32) []byte {
+	data := make([]byte, 0, len(values)*4)
+	for _, v := range values {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(v))
+	}
+	return data
+}
+
+func TestROSImageToRGBA(t *testing.T) {
+	tests := []struct {
+		name     string
+		img      sensor_msgs_msg.Image
+		depth    DepthMapping
+		expected []color.RGBA // pixels row by row
+		wantErr  bool
+	}{
+		{
+			name:     "rgb8",
+			img:      sensor_msgs_msg.Image{Width: 2, Height: 1, Step: 6, Encoding: "rgb8", Data: []byte{1, 2, 3, 4, 5, 6}},
+			expected: []color.RGBA{{1, 2, 3, 255}, {4, 5, 6, 255}},
+		},
+		{
+			name:     "bgra8 with padded rows",
+			img:      sensor_msgs_msg.Image{Width: 1, Height: 2, Step: 8, Encoding: "bgra8", Data: []byte{1, 2, 3, 4, 0, 0, 0, 0, 5, 6, 7, 8}},
+			expected: []color.RGBA{{3, 2, 1, 4}, {7, 6, 5, 8}},
+		},
+		{
+			name:     "mono8",
+			img:      sensor_msgs_msg.Image{Width: 2, Height: 1, Step: 2, Encoding: "mono8", Data: []byte{0, 200}},
+			expected: []color.RGBA{{0, 0, 0, 255}, {200, 200, 200, 255}},
+		},
+		{
+			name:     "big endian mono16",
+			img:      sensor_msgs_msg.Image{Width: 1, Height: 1, Step: 2, Encoding: "mono16", IsBigendian: 1, Data: []byte{0x12, 0x34}},
+			expected: []color.RGBA{{0x12, 0x12, 0x12, 255}},
+		},
+		{
+			name:     "rgb16",
+			img:      sensor_msgs_msg.Image{Width: 1, Height: 1, Step: 6, Encoding: "rgb16", Data: []byte{0, 1, 0, 2, 0, 3}},
+			expected: []color.RGBA{{1, 2, 3, 255}},
+		},
+		{
+			name:     "16UC1 depth with per frame range",
+			img:      sensor_msgs_msg.Image{Width: 3, Height: 1, Step: 6, Encoding: "16UC1", Data: []byte{0xe8, 0x03, 0xd0, 0x07, 0xb8, 0x0b}},
+			expected: []color.RGBA{{0, 0, 0, 255}, {128, 128, 128, 255}, {255, 255, 255, 255}},
+		},
+		{
+			name:     "32FC1 depth with bounds and jet",
+			img:      sensor_msgs_msg.Image{Width: 3, Height: 1, Step: 12, Encoding: "32FC1", Data: float32Bytes(0, float32(math.NaN()), 10)},
+			depth:    DepthMapping{Min: 0, Max: 4, Colormap: ColormapJet},
+			expected: []color.RGBA{{0, 0, 128, 255}, {0, 0, 0, 255}, {128, 0, 0, 255}},
+		},
+		{
+			name: "bayer_rggb8",
+			img: sensor_msgs_msg.Image{Width: 2, Height: 2, Step: 2, Encoding: "bayer_rggb8", Data: []byte{
+				200, 100,
+				100, 50,
+			}},
+			expected: []color.RGBA{{200, 100, 50, 255}, {200, 100, 50, 255}, {200, 100, 50, 255}, {200, 100, 50, 255}},
+		},
+		{
+			name:     "yuv422",
+			img:      sensor_msgs_msg.Image{Width: 2, Height: 1, Step: 4, Encoding: "yuv422", Data: []byte{128, 0, 128, 255}},
+			expected: []color.RGBA{{0, 0, 0, 255}, {255, 255, 255, 255}},
+		},
+		{
+			name:     "yuv422_yuy2",
+			img:      sensor_msgs_msg.Image{Width: 2, Height: 1, Step: 4, Encoding: "yuv422_yuy2", Data: []byte{0, 128, 255, 128}},
+			expected: []color.RGBA{{0, 0, 0, 255}, {255, 255, 255, 255}},
+		},
+		{
+			name: "nv21",
+			img: sensor_msgs_msg.Image{Width: 2, Height: 2, Step: 2, Encoding: "nv21", Data: []byte{
+				255, 255,
+				255, 255,
+				128, 128,
+			}},
+			expected: []color.RGBA{{255, 255, 255, 255}, {255, 255, 255, 255}, {255, 255, 255, 255}, {255, 255, 255, 255}},
+		},
+		{
+			name:    "short data",
+			img:     sensor_msgs_msg.Image{Width: 2, Height: 2, Step: 6, Encoding: "rgb8", Data: make([]byte, 10)},
+			wantErr: true,
+		},
+		{
+			name:    "unknown encoding",
+			img:     sensor_msgs_msg.Image{Width: 1, Height: 1, Step: 1, Encoding: "jpeg", Data: []byte{0}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rgba, err := ROSImageToRGBAWithDepth(&tt.img, tt.depth)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.expected {
+				x, y := i%int(tt.img.Width), i/int(tt.img.Width)
+				if got := rgba.RGBAAt(x, y); got != want {
+					t.Errorf("pixel (%d, %d) = %v, expected %v", x, y, got, want)
+				}
+			}
+		})
+	}
+}
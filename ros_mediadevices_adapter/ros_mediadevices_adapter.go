@@ -1,47 +1,201 @@
 package rosmediadevicesadapter
 
 import (
-	"fmt"
 	"image"
 	"io"
+	"log/slog"
+	"sync"
+	"time"
 
-	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
-	"github.com/pion/mediadevices/pkg/driver"
+	"github.com/3DRX/webrtc-ros-bridge/dropcount"
 	"github.com/pion/mediadevices/pkg/frame"
 	"github.com/pion/mediadevices/pkg/io/video"
 	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/tiiuae/rclgo/pkg/rclgo/types"
 )
 
+// rateSampleFrames is the number of frames the frame rate of a topic is
+// measured over when it isn't configured.
+const rateSampleFrames = 30
+
+// VideoOptions shape the frames of a video source.
+type VideoOptions struct {
+	Width     int // size of the video, taken from the first frame when 0
+	Height    int
+	FrameRate float64 // measured over the first frames when 0
+	// maps the values of depth images to colors
+	Depth DepthMapping
+	// part of the images sent, whole images when empty
+	Crop image.Rectangle
+	// filter scaling images to the size of the video, FilterBilinear when empty
+	Filter string
+}
+
 type rosImageAdapter struct {
-	lastFrame *image.RGBA
 	doneCh    chan struct{}
-	imgChan   <-chan *sensor_msgs_msg.Image
+	imgChan   <-chan types.Message
+	id        string
+	mu        sync.Mutex
 	imgWidth  int
 	imgHeight int
 	frameRate float64
+	depth     DepthMapping
+	filter    string
+	crop      image.Rectangle
+	// crop of the options, restored by an empty SetCrop
+	defaultCrop image.Rectangle
+	// frame rate discovery
+	sampled      int
+	firstSampled time.Time
+	// size of the last frame, to report changes
+	srcWidth  int
+	srcHeight int
+	// frames dropped because they can't be converted
+	drops dropcount.Counter
+}
+
+// VideoSource exposes one rosImageAdapter as a mediadevices.VideoSource,
+// so that every image topic can become its own video track.
+type VideoSource struct {
+	video.Reader
+	id      string
+	adapter *rosImageAdapter
+}
+
+func (s *VideoSource) ID() string {
+	return s.id
+}
+
+func (s *VideoSource) Close() error {
+	return s.adapter.Close()
+}
+
+// FrameRate returns the frame rate of the video, 0 while it is measured.
+func (s *VideoSource) FrameRate() float64 {
+	s.adapter.mu.Lock()
+	defer s.adapter.mu.Unlock()
+	return s.adapter.frameRate
+}
+
+// SetCrop changes the part of the images sent from the next frame on, an
+// empty crop restores the one of the options. The size of the video stays
+// the same, the crop is scaled to fit it.
+func (s *VideoSource) SetCrop(crop image.Rectangle) {
+	s.adapter.setCrop(crop)
 }
 
-func Initialize(imgChan <-chan *sensor_msgs_msg.Image, width, height int, frameRate float64) {
-	adapter := newROSImageAdapter(width, height, frameRate)
+// NewVideoSource creates a video source reading the frames of one image topic
+// from imgChan, which yields Image or CompressedImage messages, the latter
+// holding JPEG or PNG images. id becomes the ID of the video track built from it. Frames
+// whose size differs from the size of the video are scaled and letterboxed
+// to it.
+func NewVideoSource(id string, imgChan <-chan types.Message, opts VideoOptions) (*VideoSource, error) {
+	adapter := newROSImageAdapter(opts.Width, opts.Height, opts.FrameRate)
+	adapter.id = id
 	adapter.imgChan = imgChan
-	driver.GetManager().Register(adapter, driver.Info{
-		Label:      "ros_image_topic",
-		DeviceType: driver.Camera,
-		Priority:   driver.PriorityHigh,
-	})
+	adapter.depth = opts.Depth
+	adapter.filter = opts.Filter
+	adapter.crop = opts.Crop
+	adapter.defaultCrop = opts.Crop
+	if err := adapter.Open(); err != nil {
+		return nil, err
+	}
+	reader, err := adapter.VideoRecord(adapter.Properties()[0])
+	if err != nil {
+		adapter.Close()
+		return nil, err
+	}
+	return &VideoSource{
+		Reader:  reader,
+		id:      id,
+		adapter: adapter,
+	}, nil
 }
 
 func newROSImageAdapter(width, height int, frameRate float64) *rosImageAdapter {
 	return &rosImageAdapter{imgWidth: width, imgHeight: height, frameRate: frameRate}
 }
 
-func (a *rosImageAdapter) getRgba() (*image.RGBA, error) {
-	img := <-a.imgChan
-	rgba, err := ROSImageToRGBA(img)
-	if err != nil {
-		return nil, err
+func (a *rosImageAdapter) setCrop(crop image.Rectangle) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if crop.Empty() {
+		crop = a.defaultCrop
+	}
+	a.crop = crop
+	slog.Info("changed crop", "topic", a.id, "crop", crop)
+}
+
+// getFrame returns the next frame of the topic, skipping the messages that
+// can't be converted, so that a bad frame doesn't stop the encoder. The only
+// error is io.EOF once the adapter is closed.
+func (a *rosImageAdapter) getFrame() (*image.YCbCr, error) {
+	for {
+		var msg types.Message
+		select {
+		case msg = <-a.imgChan:
+		case <-a.doneCh:
+			return nil, io.EOF
+		}
+		a.mu.Lock()
+		crop := a.crop
+		a.mu.Unlock()
+		yuv, err := msgToI420(msg, crop, a.depth)
+		if err != nil {
+			a.dropFrame(err, time.Now())
+			continue
+		}
+		width, height := a.discover(yuv.Rect.Dx(), yuv.Rect.Dy(), time.Now())
+		if yuv.Rect.Dx() != width || yuv.Rect.Dy() != height {
+			yuv = letterbox(yuv, width, height, a.filter)
+		}
+		return yuv, nil
+	}
+}
+
+// dropFrame records a frame that failed to convert with err.
+func (a *rosImageAdapter) dropFrame(err error, now time.Time) {
+	if dropped := a.drops.Drop(now); dropped > 0 {
+		slog.Warn("dropped frames that can't be converted", "topic", a.id, "dropped", dropped, "error", err)
+	}
+}
+
+// discover records a frame of srcWidth x srcHeight received at now, learning
+// the size and frame rate of the topic if they aren't configured, and returns
+// the size frames are sent at.
+func (a *rosImageAdapter) discover(srcWidth, srcHeight int, now time.Time) (int, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.imgWidth == 0 || a.imgHeight == 0 {
+		a.imgWidth, a.imgHeight = srcWidth, srcHeight
+		slog.Info("discovered image size", "topic", a.id, "width", srcWidth, "height", srcHeight)
+	}
+	if srcWidth != a.srcWidth || srcHeight != a.srcHeight {
+		a.srcWidth, a.srcHeight = srcWidth, srcHeight
+		if srcWidth != a.imgWidth || srcHeight != a.imgHeight {
+			slog.Info("scaling frames to the video size",
+				"topic", a.id,
+				"frame_width", srcWidth,
+				"frame_height", srcHeight,
+				"width", a.imgWidth,
+				"height", a.imgHeight,
+			)
+		}
+	}
+	if a.frameRate == 0 {
+		if a.sampled == 0 {
+			a.firstSampled = now
+		}
+		a.sampled++
+		if a.sampled == rateSampleFrames {
+			if elapsed := now.Sub(a.firstSampled); elapsed > 0 {
+				a.frameRate = float64(a.sampled-1) / elapsed.Seconds()
+				slog.Info("discovered frame rate", "topic", a.id, "frame_rate", a.frameRate)
+			}
+			a.sampled = 0
+		}
 	}
-	return rgba, nil
+	return a.imgWidth, a.imgHeight
 }
 
 func (a *rosImageAdapter) Open() error {
@@ -61,62 +215,25 @@ func (a *rosImageAdapter) VideoRecord(selectedProp prop.Media) (video.Reader, er
 			return nil, nil, io.EOF
 		default:
 		}
-		rgba, err := a.getRgba()
+		yuv, err := a.getFrame()
 		if err != nil {
 			return nil, func() {}, err
 		}
-		return rgba, func() {}, nil
+		return yuv, func() {}, nil
 	})
 	return r, nil
 }
 
 func (a *rosImageAdapter) Properties() []prop.Media {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	supportedProp := prop.Media{
 		Video: prop.Video{
 			Width:       a.imgWidth,
 			Height:      a.imgHeight,
-			FrameFormat: frame.FormatRGBA,
+			FrameFormat: frame.FormatI420,
 			FrameRate:   float32(a.frameRate),
 		},
 	}
 	return []prop.Media{supportedProp}
 }
-
-func ROSImageToRGBA(rosImg *sensor_msgs_msg.Image) (*image.RGBA, error) {
-	width := int(rosImg.Width)
-	height := int(rosImg.Height)
-	stride := int(rosImg.Step)
-
-	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
-
-	switch rosImg.Encoding {
-	case "rgb8":
-		for y := 0; y < height; y++ {
-			for x := 0; x < width; x++ {
-				srcIdx := y*stride + x*3
-				dstIdx := y*rgba.Stride + x*4
-				rgba.Pix[dstIdx+0] = rosImg.Data[srcIdx+0] // R
-				rgba.Pix[dstIdx+1] = rosImg.Data[srcIdx+1] // G
-				rgba.Pix[dstIdx+2] = rosImg.Data[srcIdx+2] // B
-				rgba.Pix[dstIdx+3] = 255                   // A
-			}
-		}
-	case "rgba8":
-		copy(rgba.Pix, rosImg.Data)
-	case "bgr8":
-		for y := 0; y < height; y++ {
-			for x := 0; x < width; x++ {
-				srcIdx := y*stride + x*3
-				dstIdx := y*rgba.Stride + x*4
-				rgba.Pix[dstIdx+0] = rosImg.Data[srcIdx+2] // R (from B)
-				rgba.Pix[dstIdx+1] = rosImg.Data[srcIdx+1] // G
-				rgba.Pix[dstIdx+2] = rosImg.Data[srcIdx+0] // B (from R)
-				rgba.Pix[dstIdx+3] = 255                   // A
-			}
-		}
-	default:
-		return nil, fmt.Errorf("unsupported image encoding: %s", rosImg.Encoding)
-	}
-
-	return rgba, nil
-}
@@ -0,0 +1,36 @@
+package rosmediadevicesadapter
+
+import (
+	"io"
+	"testing"
+
+	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+	"github.com/tiiuae/rclgo/pkg/rclgo/types"
+)
+
+func TestGetFrameSkipsBadFrames(t *testing.T) {
+	imgChan := make(chan types.Message, 3)
+	imgChan <- &sensor_msgs_msg.Image{Width: 2, Height: 2, Step: 6, Encoding: "rgb8", Data: make([]byte, 10)}
+	imgChan <- &sensor_msgs_msg.CompressedImage{Format: "jpeg", Data: []byte{0}}
+	imgChan <- solidImage("mono8", 2, 2, []byte{200}, 1)
+	adapter := newROSImageAdapter(2, 2, 30)
+	adapter.imgChan = imgChan
+	if err := adapter.Open(); err != nil {
+		t.Fatal(err)
+	}
+	yuv, err := adapter.getFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := yuv.YCbCrAt(0, 0).Y; got != 200 {
+		t.Errorf("luma %d, expected the 200 of the only valid frame", got)
+	}
+	// the first drop is logged, the second waits for the next log
+	if adapter.drops.Pending() != 1 {
+		t.Errorf("%d drops not logged, expected 1", adapter.drops.Pending())
+	}
+	adapter.Close()
+	if _, err := adapter.getFrame(); err != io.EOF {
+		t.Errorf("error %v after close, expected io.EOF", err)
+	}
+}
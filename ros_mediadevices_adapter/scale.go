@@ -0,0 +1,122 @@
+package rosmediadevicesadapter
+
+import "image"
+
+const (
+	FilterBilinear = "bilinear"
+	FilterNearest  = "nearest"
+	FilterArea     = "area" // averages the pixels covered, sharpest when downscaling a lot
+)
+
+// letterbox scales src with filter to fit a width x height I420 image,
+// keeping its aspect ratio, and fills the remaining borders with black.
+func letterbox(src *image.YCbCr, width, height int, filter string) *image.YCbCr {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	// the largest even sized rectangle with the aspect ratio of src
+	fw, fh := width, sh*width/sw
+	if fh > height {
+		fw, fh = sw*height/sh, height
+	}
+	fw, fh = max(fw&^1, 2), max(fh&^1, 2)
+	x0, y0 := (width-fw)/2&^1, (height-fh)/2&^1
+
+	dst := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	// full range black, Y is already 0
+	for i := range dst.Cb {
+		dst.Cb[i] = 128
+		dst.Cr[i] = 128
+	}
+	resize := resizePlane
+	switch filter {
+	case FilterNearest:
+		resize = resizePlaneNearest
+	case FilterArea:
+		resize = resizePlaneArea
+	}
+	resize(
+		dst.Y[y0*dst.YStride+x0:], dst.YStride, fw, fh,
+		src.Y[src.YOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.YStride, sw, sh,
+	)
+	cx0, cy0 := x0/2, y0/2
+	csw, csh := (sw+1)/2, (sh+1)/2
+	srcC := src.COffset(src.Rect.Min.X, src.Rect.Min.Y)
+	resize(dst.Cb[cy0*dst.CStride+cx0:], dst.CStride, fw/2, fh/2, src.Cb[srcC:], src.CStride, csw, csh)
+	resize(dst.Cr[cy0*dst.CStride+cx0:], dst.CStride, fw/2, fh/2, src.Cr[srcC:], src.CStride, csw, csh)
+	return dst
+}
+
+// resizePlane bilinearly scales the sw x sh plane src to the dw x dh plane
+// dst, sampling at pixel centers with 16.16 fixed point coordinates.
+func resizePlane(dst []byte, dstStride, dw, dh int, src []byte, srcStride, sw, sh int) {
+	if dw == sw && dh == sh {
+		for y := 0; y < dh; y++ {
+			copy(dst[y*dstStride:y*dstStride+dw], src[y*srcStride:])
+		}
+		return
+	}
+	// source position of the center of each destination column
+	xs := make([]int, dw)
+	for x := range xs {
+		xs[x] = max(((2*x+1)*sw<<16)/(2*dw)-1<<15, 0)
+	}
+	forEachRowPair(dw, dh, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			sy := max(((2*y+1)*sh<<16)/(2*dh)-1<<15, 0)
+			top := min(sy>>16, sh-1)
+			bottom := min(top+1, sh-1)
+			fy := sy & 0xffff
+			topRow, bottomRow := src[top*srcStride:], src[bottom*srcStride:]
+			row := dst[y*dstStride:]
+			for x, sx := range xs {
+				left := min(sx>>16, sw-1)
+				right := min(left+1, sw-1)
+				fx := sx & 0xffff
+				t := int(topRow[left])*(1<<16-fx) + int(topRow[right])*fx
+				b := int(bottomRow[left])*(1<<16-fx) + int(bottomRow[right])*fx
+				row[x] = uint8((t>>16*(1<<16-fy) + b>>16*fy + 1<<15) >> 16)
+			}
+		}
+	})
+}
+
+// resizePlaneNearest scales like resizePlane, taking the source pixel under
+// the center of each destination pixel.
+func resizePlaneNearest(dst []byte, dstStride, dw, dh int, src []byte, srcStride, sw, sh int) {
+	xs := make([]int, dw)
+	for x := range xs {
+		xs[x] = (2*x + 1) * sw / (2 * dw)
+	}
+	forEachRowPair(dw, dh, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			srcRow := src[(2*y+1)*sh/(2*dh)*srcStride:]
+			row := dst[y*dstStride:]
+			for x, sx := range xs {
+				row[x] = srcRow[sx]
+			}
+		}
+	})
+}
+
+// resizePlaneArea scales like resizePlane, averaging the source pixels each
+// destination pixel covers.
+func resizePlaneArea(dst []byte, dstStride, dw, dh int, src []byte, srcStride, sw, sh int) {
+	forEachRowPair(dw, dh, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			sy0 := y * sh / dh
+			sy1 := max((y+1)*sh/dh, sy0+1)
+			row := dst[y*dstStride:]
+			for x := 0; x < dw; x++ {
+				sx0 := x * sw / dw
+				sx1 := max((x+1)*sw/dw, sx0+1)
+				sum := 0
+				for sy := sy0; sy < sy1; sy++ {
+					for _, p := range src[sy*srcStride+sx0 : sy*srcStride+sx1] {
+						sum += int(p)
+					}
+				}
+				n := (sy1 - sy0) * (sx1 - sx0)
+				row[x] = uint8((sum + n/2) / n)
+			}
+		}
+	})
+}
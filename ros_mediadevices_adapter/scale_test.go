@@ -0,0 +1,93 @@
+package rosmediadevicesadapter
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func solidI420(width, height int, c color.YCbCr) *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	for i := range img.Y {
+		img.Y[i] = c.Y
+	}
+	for i := range img.Cb {
+		img.Cb[i] = c.Cb
+		img.Cr[i] = c.Cr
+	}
+	return img
+}
+
+func TestLetterbox(t *testing.T) {
+	white := color.YCbCr{Y: 255, Cb: 128, Cr: 128}
+	black := color.YCbCr{Y: 0, Cb: 128, Cr: 128}
+	tests := []struct {
+		name          string
+		width, height int
+		dst           image.Rectangle
+		inside        image.Rectangle // expected to be the scaled image
+	}{
+		{"wider frame", 320, 120, image.Rect(0, 0, 160, 120), image.Rect(0, 30, 160, 90)},
+		{"taller frame", 120, 240, image.Rect(0, 0, 160, 120), image.Rect(50, 0, 110, 120)},
+		{"same aspect ratio", 320, 240, image.Rect(0, 0, 160, 120), image.Rect(0, 0, 160, 120)},
+	}
+	for _, tt := range tests {
+		for _, filter := range []string{FilterBilinear, FilterNearest, FilterArea} {
+			t.Run(tt.name+" "+filter, func(t *testing.T) {
+				dst := letterbox(solidI420(tt.width, tt.height, white), tt.dst.Dx(), tt.dst.Dy(), filter)
+				if dst.Rect != tt.dst {
+					t.Fatalf("size %v, expected %v", dst.Rect, tt.dst)
+				}
+				for y := 0; y < tt.dst.Dy(); y++ {
+					for x := 0; x < tt.dst.Dx(); x++ {
+						want := black
+						if (image.Point{x, y}).In(tt.inside) {
+							want = white
+						}
+						if got := dst.YCbCrAt(x, y); got != want {
+							t.Fatalf("pixel (%d, %d) = %v, expected %v", x, y, got, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCropToI420(t *testing.T) {
+	// a 4x4 mono8 image whose pixel values are their index
+	img := solidImage("mono8", 4, 4, []byte{0}, 1)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			img.Data[y*int(img.Step)+x] = byte(y*4 + x)
+		}
+	}
+	tests := []struct {
+		name     string
+		crop     image.Rectangle
+		expected [][]byte // rows of luma
+	}{
+		{"no crop", image.Rectangle{}, [][]byte{{0, 1, 2, 3}, {4, 5, 6, 7}, {8, 9, 10, 11}, {12, 13, 14, 15}}},
+		{"even corner", image.Rect(2, 2, 4, 4), [][]byte{{10, 11}, {14, 15}}},
+		{"odd corner", image.Rect(1, 1, 3, 3), [][]byte{{0, 1, 2}, {4, 5, 6}, {8, 9, 10}}},
+		{"out of bounds", image.Rect(2, 0, 8, 2), [][]byte{{2, 3}, {6, 7}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yuv, err := cropToI420(img, tt.crop, DepthMapping{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if yuv.Rect.Dx() != len(tt.expected[0]) || yuv.Rect.Dy() != len(tt.expected) {
+				t.Fatalf("size %v, expected %dx%d", yuv.Rect, len(tt.expected[0]), len(tt.expected))
+			}
+			for y, row := range tt.expected {
+				for x, want := range row {
+					if got := yuv.YCbCrAt(x, y).Y; got != want {
+						t.Errorf("luma at (%d, %d) = %d, expected %d", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
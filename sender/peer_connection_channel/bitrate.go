@@ -0,0 +1,71 @@
+package peerconnectionchannel
+
+import (
+	"log/slog"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/pion/webrtc/v4"
+)
+
+// retargetThreshold is the relative change of the target bitrate below
+// which the encoder is left alone.
+const retargetThreshold = 0.05
+
+// setSinkBitrate sets the share of the estimated bandwidth of a receiver's
+// peer connection that its video track of an image topic may use, and
+// retargets the encoder of the topic accordingly.
+func (h *Hub) setSinkBitrate(topic *config.TopicConfig, sink *webrtc.TrackLocalStaticSample, bitrate int) {
+	h.mu.Lock()
+	v, ok := h.videos[topic]
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.sinks[sink]; !ok {
+		return
+	}
+	v.sinks[sink] = bitrate
+	v.retarget()
+}
+
+// retarget sets the bitrate of the encoder to what the slowest receiver can
+// take, v.mu must be held.
+func (v *sharedVideo) retarget() {
+	bitrate, ok := encoderBitrate(v.sinks, v.minBitrate, v.maxBitrate)
+	if !ok || v.bitRateController == nil {
+		return
+	}
+	if abs(bitrate-v.bitrate) < int(float64(v.bitrate)*retargetThreshold) {
+		return
+	}
+	if err := v.bitRateController.SetBitRate(bitrate); err != nil {
+		slog.Warn("failed to set encoder bitrate", "topic", v.topic.NameIn, "bitrate", bitrate, "error", err)
+		return
+	}
+	slog.Info("retargeted encoder bitrate", "topic", v.topic.NameIn, "from", v.bitrate, "to", bitrate)
+	v.bitrate = bitrate
+}
+
+// encoderBitrate returns the smallest estimated share of the sinks, within
+// [minBitrate, maxBitrate], and false while no share is estimated yet.
+func encoderBitrate(sinks map[*webrtc.TrackLocalStaticSample]int, minBitrate, maxBitrate int) (int, bool) {
+	bitrate := 0
+	for _, share := range sinks {
+		if share > 0 && (bitrate == 0 || share < bitrate) {
+			bitrate = share
+		}
+	}
+	if bitrate == 0 {
+		return 0, false
+	}
+	return min(max(bitrate, minBitrate), maxBitrate), true
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
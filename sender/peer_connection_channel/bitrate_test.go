@@ -0,0 +1,32 @@
+package peerconnectionchannel
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestEncoderBitrate(t *testing.T) {
+	a := &webrtc.TrackLocalStaticSample{}
+	b := &webrtc.TrackLocalStaticSample{}
+	tests := []struct {
+		name     string
+		sinks    map[*webrtc.TrackLocalStaticSample]int
+		expected int
+		ok       bool
+	}{
+		{"no estimate yet", map[*webrtc.TrackLocalStaticSample]int{a: 0}, 0, false},
+		{"slowest receiver", map[*webrtc.TrackLocalStaticSample]int{a: 2_000_000, b: 800_000}, 800_000, true},
+		{"ignores unestimated receivers", map[*webrtc.TrackLocalStaticSample]int{a: 0, b: 1_500_000}, 1_500_000, true},
+		{"clamped to the minimum", map[*webrtc.TrackLocalStaticSample]int{a: 100_000}, 300_000, true},
+		{"clamped to the maximum", map[*webrtc.TrackLocalStaticSample]int{a: 9_000_000}, 5_000_000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bitrate, ok := encoderBitrate(tt.sinks, 300_000, 5_000_000)
+			if bitrate != tt.expected || ok != tt.ok {
+				t.Errorf("expected %d %v, got %d %v", tt.expected, tt.ok, bitrate, ok)
+			}
+		})
+	}
+}
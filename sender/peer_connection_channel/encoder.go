@@ -0,0 +1,116 @@
+package peerconnectionchannel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/vpx"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+)
+
+// libvpx deadlines per frame, see vpx_encoder.h
+var vpxDeadlines = map[string]time.Duration{
+	config.DeadlineRealtime: time.Microsecond, // VPX_DL_REALTIME
+	config.DeadlineGood:     time.Second,      // VPX_DL_GOOD_QUALITY
+	config.DeadlineBest:     0,                // VPX_DL_BEST_QUALITY
+}
+
+// videoEncoderFunc builds the encoder params of a codec from the image_spec
+// of a topic, starting at bitrate.
+type videoEncoderFunc func(spec *config.ImageSpecifications, bitrate int) (codec.VideoEncoderBuilder, error)
+
+// videoEncoders are the codecs built in. H.264 and AV1 link native libraries
+// and are only built with the h264 and av1 build tags, see encoder_h264.go
+// and encoder_av1.go.
+var videoEncoders = map[string]videoEncoderFunc{
+	config.VideoCodecVP8: newVP8Encoder,
+	config.VideoCodecVP9: newVP9Encoder,
+}
+
+// codecBuildTags are the build tags of the codecs that need one.
+var codecBuildTags = map[string]string{
+	config.VideoCodecH264: "h264",
+	config.VideoCodecAV1:  "av1",
+}
+
+// newVideoEncoder builds the encoder params of an image topic from its
+// image_spec, starting at bitrate unless the topic sets its own.
+func newVideoEncoder(spec *config.ImageSpecifications, bitrate int) (codec.VideoEncoderBuilder, error) {
+	if spec.BitRate > 0 {
+		bitrate = spec.BitRate
+	}
+	name := spec.Codec
+	if name == "" {
+		name = config.VideoCodecVP8
+	}
+	build, ok := videoEncoders[name]
+	if !ok {
+		if tag, ok := codecBuildTags[name]; ok {
+			return nil, fmt.Errorf("video codec \"%s\" isn't built in, build with -tags %s", name, tag)
+		}
+		return nil, fmt.Errorf("unsupported video codec \"%s\"", spec.Codec)
+	}
+	return build(spec, bitrate)
+}
+
+// frameRateEncoder builds its encoder once the frame rate of the video is
+// known. mediadevices only detects the size of the video from its first
+// frame, leaving the frame rate of the encoder at 0, which rate control of
+// openh264 and SVT-AV1 depends on.
+type frameRateEncoder struct {
+	codec.VideoEncoderBuilder
+	frameRate func() float64 // 0 while the frame rate is measured
+}
+
+func (e *frameRateEncoder) BuildVideoEncoder(r video.Reader, p prop.Media) (codec.ReadCloser, error) {
+	// frames read while the frame rate is measured aren't sent
+	for e.frameRate() == 0 {
+		_, release, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+		release()
+	}
+	p.FrameRate = float32(e.frameRate())
+	return e.VideoEncoderBuilder.BuildVideoEncoder(r, p)
+}
+
+func newVP8Encoder(spec *config.ImageSpecifications, bitrate int) (codec.VideoEncoderBuilder, error) {
+	params, err := vpx.NewVP8Params()
+	if err != nil {
+		return nil, err
+	}
+	setVPXParams(&params.Params, spec, bitrate)
+	return &params, nil
+}
+
+func newVP9Encoder(spec *config.ImageSpecifications, bitrate int) (codec.VideoEncoderBuilder, error) {
+	params, err := vpx.NewVP9Params()
+	if err != nil {
+		return nil, err
+	}
+	setVPXParams(&params.Params, spec, bitrate)
+	return &params, nil
+}
+
+func setVPXParams(params *vpx.Params, spec *config.ImageSpecifications, bitrate int) {
+	params.BitRate = bitrate
+	if spec.KeyFrameInterval > 0 {
+		params.KeyFrameInterval = spec.KeyFrameInterval
+	}
+	switch spec.RateControl {
+	case config.RateControlCBR:
+		params.RateControlEndUsage = vpx.RateControlCBR
+	case config.RateControlVBR:
+		params.RateControlEndUsage = vpx.RateControlVBR
+	}
+	if deadline, ok := vpxDeadlines[spec.Deadline]; ok {
+		params.Deadline = deadline
+	}
+	if spec.ErrorResilient {
+		params.ErrorResilient = vpx.ErrorResilientDefault
+	}
+}
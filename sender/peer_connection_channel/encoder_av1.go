@@ -0,0 +1,29 @@
+//go:build av1
+
+package peerconnectionchannel
+
+import (
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/svtav1"
+)
+
+func init() {
+	videoEncoders[config.VideoCodecAV1] = newAV1Encoder
+}
+
+func newAV1Encoder(spec *config.ImageSpecifications, bitrate int) (codec.VideoEncoderBuilder, error) {
+	// SVT-AV1 in real-time mode, better quality per bit for cellular links
+	params, err := svtav1.NewParams()
+	if err != nil {
+		return nil, err
+	}
+	params.BitRate = bitrate
+	if spec.KeyFrameInterval > 0 {
+		params.KeyFrameInterval = spec.KeyFrameInterval
+	}
+	if spec.Preset > 0 {
+		params.Preset = spec.Preset
+	}
+	return &params, nil
+}
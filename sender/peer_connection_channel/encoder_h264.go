@@ -0,0 +1,29 @@
+//go:build h264
+
+package peerconnectionchannel
+
+import (
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/openh264"
+)
+
+func init() {
+	videoEncoders[config.VideoCodecH264] = newH264Encoder
+}
+
+func newH264Encoder(spec *config.ImageSpecifications, bitrate int) (codec.VideoEncoderBuilder, error) {
+	// openh264 is a software encoder, linked statically by default
+	params, err := openh264.NewParams()
+	if err != nil {
+		return nil, err
+	}
+	params.BitRate = bitrate
+	if spec.KeyFrameInterval > 0 {
+		params.IntraPeriod = uint(spec.KeyFrameInterval)
+	}
+	// bitrate mode keeps to the bitrate set by congestion control, the
+	// config rejects vbr for h264
+	params.RCMode = openh264.RCBitrateMode
+	return &params, nil
+}
@@ -0,0 +1,32 @@
+//go:build h264
+
+package peerconnectionchannel
+
+import (
+	"testing"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/pion/mediadevices/pkg/codec/openh264"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestNewH264Encoder(t *testing.T) {
+	builder, err := newVideoEncoder(&config.ImageSpecifications{
+		Codec:            config.VideoCodecH264,
+		BitRate:          800_000,
+		KeyFrameInterval: 60,
+	}, 2_000_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h264, ok := builder.(*openh264.Params)
+	if !ok {
+		t.Fatalf("expected h264 params, got %T", builder)
+	}
+	if h264.BitRate != 800_000 || h264.IntraPeriod != 60 {
+		t.Errorf("expected the topic's bitrate and keyframe interval, got %d and %d", h264.BitRate, h264.IntraPeriod)
+	}
+	if builder.RTPCodec().MimeType != webrtc.MimeTypeH264 {
+		t.Errorf("expected %s, got %s", webrtc.MimeTypeH264, builder.RTPCodec().MimeType)
+	}
+}
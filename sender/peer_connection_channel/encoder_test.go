@@ -0,0 +1,72 @@
+package peerconnectionchannel
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/vpx"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+)
+
+func TestNewVideoEncoder(t *testing.T) {
+	builder, err := newVideoEncoder(&config.ImageSpecifications{
+		Codec:            config.VideoCodecVP9,
+		KeyFrameInterval: 30,
+		RateControl:      config.RateControlCBR,
+		Deadline:         config.DeadlineGood,
+		ErrorResilient:   true,
+	}, 2_000_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp9, ok := builder.(*vpx.VP9Params)
+	if !ok {
+		t.Fatalf("expected vp9 params, got %T", builder)
+	}
+	if vp9.BitRate != 2_000_000 || vp9.KeyFrameInterval != 30 ||
+		vp9.RateControlEndUsage != vpx.RateControlCBR || vp9.Deadline != time.Second ||
+		vp9.ErrorResilient != vpx.ErrorResilientDefault {
+		t.Errorf("unexpected vp9 params %+v", vp9.Params)
+	}
+
+	if _, err := newVideoEncoder(&config.ImageSpecifications{Codec: "mjpeg"}, 2_000_000); err == nil {
+		t.Error("expected an error for an unsupported codec")
+	}
+}
+
+type propRecorder struct {
+	codec.VideoEncoderBuilder
+	prop prop.Media
+}
+
+func (b *propRecorder) BuildVideoEncoder(r video.Reader, p prop.Media) (codec.ReadCloser, error) {
+	b.prop = p
+	return nil, nil
+}
+
+func TestFrameRateEncoder(t *testing.T) {
+	// the frame rate is known after three frames
+	read := 0
+	r := video.ReaderFunc(func() (image.Image, func(), error) {
+		read++
+		return image.NewYCbCr(image.Rect(0, 0, 2, 2), image.YCbCrSubsampleRatio420), func() {}, nil
+	})
+	frameRate := func() float64 {
+		if read < 3 {
+			return 0
+		}
+		return 15
+	}
+	recorder := &propRecorder{}
+	encoder := &frameRateEncoder{recorder, frameRate}
+	if _, err := encoder.BuildVideoEncoder(r, prop.Media{Video: prop.Video{Width: 2, Height: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if read != 3 || recorder.prop.FrameRate != 15 || recorder.prop.Width != 2 {
+		t.Errorf("expected the encoder built at 15 fps after 3 frames, got %+v after %d frames", recorder.prop.Video, read)
+	}
+}
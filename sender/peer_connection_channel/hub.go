@@ -0,0 +1,371 @@
+package peerconnectionchannel
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	rosmediadevicesadapter "github.com/3DRX/webrtc-ros-bridge/ros_mediadevices_adapter"
+	send_roschannel "github.com/3DRX/webrtc-ros-bridge/sender/ros_channel"
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+	"github.com/tiiuae/rclgo/pkg/rclgo/types"
+)
+
+// Hub shares the ROS messages between the peer connections of every
+// receiver: sensor messages are serialized once and handed to each peer
+// connection's scheduler, and each image topic is encoded once for all of its video tracks.
+type Hub struct {
+	mailboxes     *send_roschannel.Mailboxes
+	codecselector *mediadevices.CodecSelector
+	videoCodecs   map[string]webrtc.RTPCodecCapability // image_spec.codec -> codec
+	mu            sync.Mutex
+	schedulers    map[*sensorScheduler]struct{}
+	videos        map[*config.TopicConfig]*sharedVideo
+	minBitrate    int
+	maxBitrate    int
+}
+
+// sharedVideo is the encoder of one image topic, writing every encoded frame
+// to the video tracks of the receivers that asked for the topic.
+type sharedVideo struct {
+	topic              *config.TopicConfig
+	imgChan            chan types.Message // Image or CompressedImage
+	source             *rosmediadevicesadapter.VideoSource
+	track              mediadevices.Track
+	mu                 sync.Mutex
+	sinks              map[*webrtc.TrackLocalStaticSample]int // sink -> bitrate share, 0 until estimated
+	keyFrameController codec.KeyFrameController
+	bitRateController  codec.BitRateController
+	bitrate            int // current target of the encoder
+	minBitrate         int
+	maxBitrate         int
+}
+
+var videoCodecNames = []string{
+	config.VideoCodecVP8,
+	config.VideoCodecVP9,
+	config.VideoCodecH264,
+	config.VideoCodecAV1,
+}
+
+func InitHub(cfg *config.Config, mailboxes *send_roschannel.Mailboxes) *Hub {
+	// the codec of every image topic must be built in
+	for i := range cfg.Topics {
+		topic := &cfg.Topics[i]
+		if !topic.IsVideo() {
+			continue
+		}
+		if _, err := newVideoEncoder(&topic.ImgSpec, cfg.MaxBitrate); err != nil {
+			panic(fmt.Errorf("image topic \"%s\": %w", topic.NameIn, err))
+		}
+	}
+	// the shared selector registers every codec built in with the peer
+	// connections, each image topic gets an encoder built from its own image_spec
+	builders := make([]codec.VideoEncoderBuilder, 0, len(videoCodecNames))
+	videoCodecs := make(map[string]webrtc.RTPCodecCapability, len(videoCodecNames))
+	for _, name := range videoCodecNames {
+		if _, ok := videoEncoders[name]; !ok {
+			continue
+		}
+		builder, err := newVideoEncoder(&config.ImageSpecifications{Codec: name}, cfg.MaxBitrate)
+		if err != nil {
+			panic(err)
+		}
+		builders = append(builders, builder)
+		videoCodecs[name] = builder.RTPCodec().RTPCodecCapability
+	}
+	codecselector := mediadevices.NewCodecSelector(
+		mediadevices.WithVideoEncoders(builders...),
+	)
+	return &Hub{
+		mailboxes:     mailboxes,
+		codecselector: codecselector,
+		videoCodecs:   videoCodecs,
+		schedulers:    make(map[*sensorScheduler]struct{}),
+		videos:        make(map[*config.TopicConfig]*sharedVideo),
+		minBitrate:    cfg.MinBitrate,
+		maxBitrate:    cfg.MaxBitrate,
+	}
+}
+
+// Spin dispatches the ROS messages to the peer connections.
+func (h *Hub) Spin() {
+	for {
+		msg := h.mailboxes.Take()
+		if msg.Topic.IsVideo() {
+			h.mu.Lock()
+			v, ok := h.videos[msg.Topic]
+			h.mu.Unlock()
+			if !ok {
+				continue
+			}
+			v.putImage(msg.Msg)
+			continue
+		}
+		if msg.Msg != nil {
+			serialized, err := rclgo.Serialize(msg.Msg)
+			if err != nil {
+				slog.Error("failed to serialize sensor message", "error", err)
+				continue
+			}
+			msg = send_roschannel.TopicMessage{Topic: msg.Topic, Serialized: serialized}
+		}
+		// compressed once for every receiver, the envelope announces the codec
+		compressed, err := msg.Topic.Codec().Compress(msg.Serialized)
+		if err != nil {
+			slog.Error("failed to compress sensor message", "topic", msg.Topic.NameIn, "error", err)
+			continue
+		}
+		msg.Serialized = compressed
+		h.mu.Lock()
+		for scheduler := range h.schedulers {
+			scheduler.push(msg)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *Hub) addScheduler() *sensorScheduler {
+	scheduler := newSensorScheduler()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.schedulers[scheduler] = struct{}{}
+	return scheduler
+}
+
+func (h *Hub) removeScheduler(scheduler *sensorScheduler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.schedulers, scheduler)
+}
+
+// addVideoSink starts writing the encoded frames of an image topic to sink,
+// starting the encoder of the topic if it isn't running yet.
+func (h *Hub) addVideoSink(topic *config.TopicConfig, sink *webrtc.TrackLocalStaticSample) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.videos[topic]
+	if !ok {
+		var err error
+		v, err = h.newSharedVideo(topic)
+		if err != nil {
+			return err
+		}
+		h.videos[topic] = v
+	}
+	v.mu.Lock()
+	v.sinks[sink] = 0
+	v.mu.Unlock()
+	// the new receiver can't decode anything before the next keyframe
+	v.forceKeyFrame()
+	return nil
+}
+
+// removeVideoSink stops writing to sink, stopping the encoder of the topic
+// once no sink is left.
+func (h *Hub) removeVideoSink(topic *config.TopicConfig, sink *webrtc.TrackLocalStaticSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.videos[topic]
+	if !ok {
+		return
+	}
+	v.mu.Lock()
+	delete(v.sinks, sink)
+	empty := len(v.sinks) == 0
+	if !empty {
+		// the receiver left may have been the one holding the bitrate down
+		v.retarget()
+	}
+	v.mu.Unlock()
+	if !empty {
+		return
+	}
+	delete(h.videos, topic)
+	if err := v.track.Close(); err != nil {
+		slog.Error("failed to close video track", "topic", topic.NameIn, "error", err)
+	}
+}
+
+func (h *Hub) forceKeyFrame(topic *config.TopicConfig) {
+	h.mu.Lock()
+	v, ok := h.videos[topic]
+	h.mu.Unlock()
+	if ok {
+		v.forceKeyFrame()
+	}
+}
+
+// SetCrop changes the part of the images of topic its video shows, for
+// every receiver of the topic. An empty crop restores the configured one.
+func (h *Hub) SetCrop(topic *config.TopicConfig, crop image.Rectangle) {
+	h.mu.Lock()
+	v, ok := h.videos[topic]
+	h.mu.Unlock()
+	if !ok {
+		slog.Warn("no video to crop", "topic", topic.NameIn)
+		return
+	}
+	v.source.SetCrop(crop)
+}
+
+func (h *Hub) newSharedVideo(topic *config.TopicConfig) (*sharedVideo, error) {
+	// the encoder only ever sees the latest image, see putImage
+	imgChan := make(chan types.Message, 1)
+	width, height := topic.ImgSpec.VideoSize()
+	opts := rosmediadevicesadapter.VideoOptions{
+		Width:     width,
+		Height:    height,
+		FrameRate: topic.ImgSpec.FrameRate,
+		Depth: rosmediadevicesadapter.DepthMapping{
+			Min:      topic.ImgSpec.DepthMin,
+			Max:      topic.ImgSpec.DepthMax,
+			Colormap: topic.ImgSpec.Colormap,
+		},
+		Filter: topic.ImgSpec.ScalingFilter,
+	}
+	if topic.ImgSpec.Crop != nil {
+		opts.Crop = topic.ImgSpec.Crop.Rectangle()
+	}
+	source, err := rosmediadevicesadapter.NewVideoSource(topic.NameIn, imgChan, opts)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := newVideoEncoder(&topic.ImgSpec, h.maxBitrate)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	track := mediadevices.NewVideoTrack(source, mediadevices.NewCodecSelector(
+		mediadevices.WithVideoEncoders(&frameRateEncoder{encoder, source.FrameRate}),
+	))
+	track.OnEnded(func(err error) {
+		slog.Error("Track ended", "topic", topic.NameIn, "error", err)
+	})
+	maxBitrate := h.maxBitrate
+	if topic.ImgSpec.BitRate > 0 {
+		maxBitrate = topic.ImgSpec.BitRate
+	}
+	v := &sharedVideo{
+		topic:   topic,
+		imgChan: imgChan,
+		source:  source,
+		track:   track,
+		sinks:   make(map[*webrtc.TrackLocalStaticSample]int),
+		// the encoder starts at the maximum until the bandwidth is estimated
+		bitrate:    maxBitrate,
+		minBitrate: min(h.minBitrate, maxBitrate),
+		maxBitrate: maxBitrate,
+	}
+	go func() {
+		v.encode(h.videoCodecOf(topic))
+		h.dropVideo(v)
+	}()
+	return v, nil
+}
+
+// dropVideo forgets a video whose encoder stopped on its own, so that the
+// next addVideoSink of its topic starts a new encoder.
+func (h *Hub) dropVideo(v *sharedVideo) {
+	h.mu.Lock()
+	current := h.videos[v.topic] == v
+	if current {
+		delete(h.videos, v.topic)
+	}
+	h.mu.Unlock()
+	if !current {
+		// removeVideoSink closed it already
+		return
+	}
+	slog.Warn("video stopped, restarting it with the next receiver", "topic", v.topic.NameIn)
+	if err := v.track.Close(); err != nil {
+		slog.Error("failed to close video track", "topic", v.topic.NameIn, "error", err)
+	}
+}
+
+// videoCodecOf returns the codec the video tracks of an image topic are
+// encoded with.
+func (h *Hub) videoCodecOf(topic *config.TopicConfig) webrtc.RTPCodecCapability {
+	if videoCodec, ok := h.videoCodecs[topic.ImgSpec.Codec]; ok {
+		return videoCodec
+	}
+	return h.videoCodecs[config.VideoCodecVP8]
+}
+
+// putImage hands img to the encoder, replacing the image it hasn't read yet.
+// The hub is the only writer of imgChan, so the second send never blocks.
+func (v *sharedVideo) putImage(img types.Message) {
+	select {
+	case v.imgChan <- img:
+		return
+	default:
+	}
+	select {
+	case <-v.imgChan:
+	default:
+	}
+	select {
+	case v.imgChan <- img:
+	default:
+	}
+}
+
+// encode runs the encoder until the video track is closed. Creating the
+// encoder waits for the first image of the topic, and for its frame rate to
+// be measured when it isn't configured.
+func (v *sharedVideo) encode(videoCodec webrtc.RTPCodecCapability) {
+	encodedReader, err := v.track.NewEncodedReader(videoCodec.MimeType)
+	if err != nil {
+		slog.Error("failed to create encoder", "topic", v.topic.NameIn, "error", err)
+		return
+	}
+	defer encodedReader.Close()
+	v.mu.Lock()
+	if keyFrameController, ok := encodedReader.Controller().(codec.KeyFrameController); ok {
+		v.keyFrameController = keyFrameController
+	}
+	if bitRateController, ok := encodedReader.Controller().(codec.BitRateController); ok {
+		v.bitRateController = bitRateController
+		v.retarget()
+	}
+	v.mu.Unlock()
+	slog.Info("encoder started", "topic", v.topic.NameIn)
+	clockRate := time.Duration(videoCodec.ClockRate)
+	for {
+		buffer, release, err := encodedReader.Read()
+		if err != nil {
+			slog.Info("encoder stopped", "topic", v.topic.NameIn, "error", err)
+			return
+		}
+		sample := media.Sample{
+			Data:     buffer.Data,
+			Duration: time.Duration(buffer.Samples) * time.Second / clockRate,
+		}
+		v.mu.Lock()
+		for sink := range v.sinks {
+			if err := sink.WriteSample(sample); err != nil {
+				slog.Error("failed to write video sample", "topic", v.topic.NameIn, "error", err)
+			}
+		}
+		v.mu.Unlock()
+		release()
+	}
+}
+
+func (v *sharedVideo) forceKeyFrame() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.keyFrameController == nil {
+		return
+	}
+	if err := v.keyFrameController.ForceKeyFrame(); err != nil {
+		slog.Warn("failed to force key frame", "topic", v.topic.NameIn, "error", err)
+	}
+}
@@ -1,241 +1,404 @@
 package peerconnectionchannel
 
 import (
-	"encoding/json"
-	"errors"
+	"fmt"
 	"log/slog"
+	"math"
+	"sync"
+	"time"
+
 	"github.com/3DRX/webrtc-ros-bridge/config"
-	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
-	rosmediadevicesadapter "github.com/3DRX/webrtc-ros-bridge/ros_mediadevices_adapter"
+	"github.com/3DRX/webrtc-ros-bridge/envelope"
 	send_signalingchannel "github.com/3DRX/webrtc-ros-bridge/sender/signaling_channel"
 	"github.com/pion/interceptor"
-	"github.com/pion/mediadevices"
-	"github.com/pion/mediadevices/pkg/codec/vpx"
-	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 	"github.com/tiiuae/rclgo/pkg/rclgo"
-	"github.com/tiiuae/rclgo/pkg/rclgo/types"
 )
 
-type AddStreamAction struct {
-	Type string `json:"type"`
-	Id   string `json:"id"`
-}
+// how long fragments of a message are kept waiting for the missing ones
+const reassemblyTimeout = 5 * time.Second
 
-type AddVideoTrackAction struct {
-	Type     string `json:"type"`
-	Id       string `json:"id"`
-	StreamId string `json:"stream_id"`
-	SrcId    string `json:"src"`
-}
+// initialBitrate is where congestion control starts estimating the bandwidth
+// from, within the configured bounds.
+const initialBitrate = 1_000_000
+
+const (
+	// relative change of the bandwidth estimate that gets logged right away
+	estimateLogThreshold = 0.2
+	// maximum time between two logs of an unchanged bandwidth estimate
+	estimateLogInterval = 30 * time.Second
+)
 
 type PeerConnectionChannel struct {
-	imgChan           <-chan *sensor_msgs_msg.Image
-	sensorChan        <-chan types.Message
-	chanDispatcher    func()
+	cfg               *config.Config
+	hub               *Hub
+	publish           func(topic string, msgType string, serialized []byte) error
+	videoSinks        map[*webrtc.TrackLocalStaticSample]*config.TopicConfig
 	sendSDPChan       chan<- webrtc.SessionDescription
 	recvSDPChan       <-chan webrtc.SessionDescription
 	sendCandidateChan chan<- webrtc.ICECandidateInit
 	recvCandidateChan <-chan webrtc.ICECandidateInit
 	peerConnection    *webrtc.PeerConnection
+	estimator         cc.BandwidthEstimator
+	done              chan struct{}
+	closeOnce         sync.Once
+
+	// last logged bandwidth estimate
+	estimateMu      sync.Mutex
+	loggedEstimate  int
+	lastEstimateLog time.Time
 }
 
 func InitPeerConnectionChannel(
-	messageChan <-chan types.Message,
+	hub *Hub,
+	publish func(topic string, msgType string, serialized []byte) error,
 	sendSDPChan chan<- webrtc.SessionDescription,
 	recvSDPChan <-chan webrtc.SessionDescription,
 	sendCandidateChan chan<- webrtc.ICECandidateInit,
 	recvCandidateChan <-chan webrtc.ICECandidateInit,
-	action *send_signalingchannel.Action,
-	imgSpec *config.ImageSpecifications,
-) *PeerConnectionChannel {
-	// parse action
-	if action.Type != "configure" {
-		panic("Invalid action type")
-	}
-	rawActions := action.Actions
-	if len(rawActions) != 2 {
-		panic("Invalid number of actions")
-	}
-	rawAddStream := rawActions[0]
-	rawAddVideoTrack := rawActions[1]
-	// bind raw actions to struct
-	addStreamAction := AddStreamAction{}
-	addVideoTrackAction := AddVideoTrackAction{}
-	if err := unmarshalAction(rawAddStream, &addStreamAction); err != nil {
-		panic(err)
-	}
-	if err := unmarshalAction(rawAddVideoTrack, &addVideoTrackAction); err != nil {
-		panic(err)
-	}
-	// TODO: read data from action and use the action to select
-	// ROS topic to send through bridge.
-	// For now, we just send the ROS topic specified in the config.
-
-	// create a dispatch goroutine to split image message from other sensor messages
-	imgChan := make(chan *sensor_msgs_msg.Image, 10)
-	sensorChan := make(chan types.Message, 10)
-	var imgWidth, imgHeight int = 640, 480
-	var frameRate float64 = 30.00
-	if imgSpec.Width != 0 && imgSpec.Height != 0  && imgSpec.FrameRate != 0 {
-		imgWidth = imgSpec.Width
-		imgHeight = imgSpec.Height
-		frameRate = imgSpec.FrameRate
-	}
-
-	rosmediadevicesadapter.Initialize(imgChan, imgWidth, imgHeight, frameRate)
-	vp8Params, err := vpx.NewVP8Params()
-	if err != nil {
-		panic(err)
-	}
-	vp8Params.BitRate = 5_000_000
-	codecselector := mediadevices.NewCodecSelector(
-		mediadevices.WithVideoEncoders(&vp8Params),
-	)
+	videoTracks []send_signalingchannel.VideoTrack,
+	cfg *config.Config,
+) (*PeerConnectionChannel, error) {
 	m := &webrtc.MediaEngine{}
-	codecselector.Populate(m)
+	hub.codecselector.Populate(m)
 	i := &interceptor.Registry{}
+	// GCC estimates the bandwidth from the receiver's transport-wide
+	// congestion control feedback
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(min(max(initialBitrate, cfg.MinBitrate), cfg.MaxBitrate)),
+			gcc.SendSideBWEMinBitrate(cfg.MinBitrate),
+			gcc.SendSideBWEMaxBitrate(cfg.MaxBitrate),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	estimatorChan := make(chan cc.BandwidthEstimator, 1)
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		estimatorChan <- estimator
+	})
+	i.Add(congestionController)
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, err
+	}
 	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-		panic(err)
+		return nil, err
 	}
 	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
-	peerConnection, err := api.NewPeerConnection(config)
+	rtcConfig := cfg.RTCConfiguration()
+	peerConnection, err := api.NewPeerConnection(rtcConfig)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	// the estimator is created along with the peer connection
+	estimator := <-estimatorChan
 	slog.Info("Created peer connection")
 
-	mediaStream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
-		Video: func(constraint *mediadevices.MediaTrackConstraints) {
-			constraint.Width = prop.Int(imgWidth)
-			constraint.Height = prop.Int(imgHeight)
-			constraint.FrameRate = prop.Float(frameRate)
-		},
-		Codec: codecselector,
-	})
-	if err != nil {
-		panic(err)
-	}
-	for _, videoTrack := range mediaStream.GetVideoTracks() {
-		videoTrack.OnEnded(func(err error) {
-			slog.Error("Track ended", "error", err)
-		})
-		_, err := peerConnection.AddTransceiverFromTrack(
-			videoTrack,
-			webrtc.RTPTransceiverInit{
-				Direction: webrtc.RTPTransceiverDirectionSendonly,
-			},
-		)
-		if err != nil {
-			panic(err)
-		}
-		slog.Info("add video track success")
-	}
-
 	pc := &PeerConnectionChannel{
+		cfg:               cfg,
+		hub:               hub,
+		publish:           publish,
+		videoSinks:        make(map[*webrtc.TrackLocalStaticSample]*config.TopicConfig),
 		sendSDPChan:       sendSDPChan,
 		recvSDPChan:       recvSDPChan,
 		sendCandidateChan: sendCandidateChan,
 		recvCandidateChan: recvCandidateChan,
 		peerConnection:    peerConnection,
-		imgChan:           imgChan,
-		sensorChan:        sensorChan,
-		chanDispatcher: func() {
-			for {
-				msg := <-messageChan
-				switch msg.(type) {
-				case *sensor_msgs_msg.Image:
-					imgChan <- msg.(*sensor_msgs_msg.Image)
-				default:
-					sensorChan <- msg
-				}
+		estimator:         estimator,
+		done:              make(chan struct{}),
+	}
+	// every requested image topic gets its own video track, fed by the
+	// encoder the hub shares between receivers
+	for _, track := range videoTracks {
+		topic := track.Topic
+		videoTrack, err := webrtc.NewTrackLocalStaticSample(hub.videoCodecOf(topic), track.Id, track.StreamId)
+		if err == nil {
+			var rtpSender *webrtc.RTPSender
+			if rtpSender, err = peerConnection.AddTrack(videoTrack); err == nil {
+				go pc.handleRTCP(rtpSender, topic)
 			}
-		},
+		}
+		if err != nil {
+			peerConnection.Close()
+			return nil, fmt.Errorf("failed to add video track \"%s\": %w", track.Id, err)
+		}
+		pc.videoSinks[videoTrack] = topic
+		slog.Info("add video track success", "topic", topic.NameIn, "track", track.Id, "stream", track.StreamId)
+	}
+	return pc, nil
+}
+
+// handleRTCP reads the RTCP of a video track, asking the encoder of its
+// topic for a keyframe whenever the receiver lost the picture.
+func (pc *PeerConnectionChannel) handleRTCP(rtpSender *webrtc.RTPSender, topic *config.TopicConfig) {
+	for {
+		pkts, _, err := rtpSender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				pc.hub.forceKeyFrame(topic)
+			}
+		}
 	}
-	return pc
 }
 
 func (pc *PeerConnectionChannel) handleRemoteICECandidate() {
 	for {
-		candidate := <-pc.recvCandidateChan
-		if err := pc.peerConnection.AddICECandidate(candidate); err != nil {
-			panic(err)
+		select {
+		case candidate := <-pc.recvCandidateChan:
+			if err := pc.peerConnection.AddICECandidate(candidate); err != nil {
+				slog.Error("failed to add ICE candidate", "error", err)
+			}
+		case <-pc.done:
+			return
 		}
 	}
 }
 
-func (pc *PeerConnectionChannel) Spin() {
-	go pc.chanDispatcher()
+// Close tears down the peer connection and its video tracks.
+func (pc *PeerConnectionChannel) Close() {
+	pc.closeOnce.Do(func() {
+		close(pc.done)
+		for sink, topic := range pc.videoSinks {
+			pc.hub.removeVideoSink(topic, sink)
+		}
+		if err := pc.peerConnection.Close(); err != nil {
+			slog.Error("failed to close peer connection", "error", err)
+		}
+	})
+}
 
-	datachannel, err := pc.peerConnection.CreateDataChannel("data", nil)
-	if err != nil {
-		panic(err)
+// Done is closed once the peer connection has failed or been closed.
+func (pc *PeerConnectionChannel) Done() <-chan struct{} {
+	return pc.done
+}
+
+// Spin starts the video tracks and data channels and negotiates the peer
+// connection with the receiver. It returns an error when the negotiation
+// fails, leaving it to the caller to close the session.
+func (pc *PeerConnectionChannel) Spin() error {
+	for sink, topic := range pc.videoSinks {
+		if err := pc.hub.addVideoSink(topic, sink); err != nil {
+			slog.Error("failed to start video", "topic", topic.NameIn, "error", err)
+		}
 	}
-	datachannel.OnOpen(func() {
-		slog.Info("datachannel open", "label", datachannel.Label(), "ID", datachannel.ID())
-		for {
-			sensorMsg := <-pc.sensorChan
-			serializedMsg, err := rclgo.Serialize(sensorMsg)
-			if err != nil {
-				slog.Error("failed to serialize sensor message", "error", err)
-				continue
-			}
-			datachannel.Send(serializedMsg)
+	pc.estimator.OnTargetBitrateChange(pc.setTargetBitrate)
+	pc.setTargetBitrate(pc.estimator.GetTargetBitrate())
+
+	pc.peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		slog.Info("peer connection state changed", "state", state)
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			// closing waits for the peer connection, which is running this handler
+			go pc.Close()
 		}
 	})
-	datachannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-		slog.Info("datachannel message", "data", string(msg.Data))
-	})
+	// one data channel per data topic, labelled with the topic's wire name
+	dataChannels := make(map[*config.TopicConfig]*webrtc.DataChannel)
+	for i := range pc.cfg.Topics {
+		topic := &pc.cfg.Topics[i]
+		if topic.IsVideo() {
+			continue
+		}
+		label := topic.WireName(pc.cfg.Mode)
+		datachannel, err := pc.peerConnection.CreateDataChannel(label, dataChannelInit(topic.Qos))
+		if err != nil {
+			return fmt.Errorf("failed to create data channel \"%s\": %w", label, err)
+		}
+		datachannel.OnOpen(func() {
+			slog.Info("datachannel open", "label", datachannel.Label(), "ID", datachannel.ID())
+		})
+		if topic.SubscribedBy(pc.cfg.Mode) {
+			dataChannels[topic] = datachannel
+			continue
+		}
+		codec := topic.Codec()
+		reassembler := envelope.NewReassembler(reassemblyTimeout, func(topic string, seq uint64) {
+			slog.Warn("discarding incomplete message", "topic", topic, "seq", seq)
+		})
+		go expireFragments(reassembler, pc.done)
+		datachannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			if msg.IsString {
+				slog.Info("datachannel message", "label", label, "data", string(msg.Data))
+				return
+			}
+			fragment, err := envelope.Unmarshal(msg.Data)
+			if err != nil {
+				slog.Error("failed to unwrap datachannel message", "label", label, "error", err)
+				return
+			}
+			env, err := reassembler.Add(fragment)
+			if err != nil {
+				slog.Error("failed to reassemble datachannel message", "label", label, "error", err)
+				return
+			}
+			if env == nil {
+				return
+			}
+			payload, err := env.DecompressPayload(codec)
+			if err != nil {
+				slog.Error("failed to decompress datachannel message", "label", label, "error", err)
+				return
+			}
+			if err := pc.publish(label, env.Type, payload); err != nil {
+				slog.Error("dropping received message", "topic", label, "type", env.Type, "error", err)
+			}
+		})
+	}
+	go pc.sendSensorMessages(dataChannels)
 
 	offer, err := pc.peerConnection.CreateOffer(nil)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err := pc.peerConnection.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
 	}
-	pc.peerConnection.SetLocalDescription(offer)
 	pc.peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
 			return
 		}
-		pc.sendCandidateChan <- c.ToJSON()
+		select {
+		case pc.sendCandidateChan <- c.ToJSON():
+		case <-pc.done:
+		}
 	})
 	go pc.handleRemoteICECandidate()
-	pc.sendSDPChan <- offer
-	remoteSDP := <-pc.recvSDPChan
-	pc.peerConnection.SetRemoteDescription(remoteSDP)
+	select {
+	case pc.sendSDPChan <- offer:
+	case <-pc.done:
+		return nil
+	}
+	select {
+	case remoteSDP := <-pc.recvSDPChan:
+		if err := pc.peerConnection.SetRemoteDescription(remoteSDP); err != nil {
+			return fmt.Errorf("failed to set remote description: %w", err)
+		}
+	case <-pc.done:
+	}
+	return nil
 }
 
-func unmarshalAction(rawAction interface{}, action interface{}) error {
-	rawActionMap, ok := rawAction.(map[string]interface{})
-	if !ok {
-		return errors.New("Invalid action type")
+// sendSensorMessages sends the sensor messages of every topic on its data
+// channel, by priority, until the peer connection is closed. Messages of a
+// topic are dropped until its data channel is open.
+func (pc *PeerConnectionChannel) sendSensorMessages(dataChannels map[*config.TopicConfig]*webrtc.DataChannel) {
+	seqs := make(map[string]uint64)
+	scheduler := pc.hub.addScheduler()
+	defer pc.hub.removeScheduler(scheduler)
+	for _, datachannel := range dataChannels {
+		datachannel.SetBufferedAmountLowThreshold(lowBufferedAmount)
+		datachannel.OnBufferedAmountLow(scheduler.notify)
 	}
-	rawActionBytes, err := json.Marshal(rawActionMap)
-	if err != nil {
-		return err
+	congested := func(topic *config.TopicConfig) bool {
+		datachannel, ok := dataChannels[topic]
+		return ok && datachannel.BufferedAmount() > maxBufferedAmount
 	}
-	if err := json.Unmarshal(rawActionBytes, action); err != nil {
-		return err
+	for {
+		sensorMsg, ok := scheduler.next(congested, pc.done)
+		if !ok {
+			return
+		}
+		topic := sensorMsg.Topic
+		datachannel, ok := dataChannels[topic]
+		if !ok || datachannel.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		env := &envelope.Envelope{
+			Topic:     topic.NameOut,
+			Type:      topic.Type,
+			Seq:       seqs[topic.NameOut],
+			Timestamp: time.Now(),
+			Payload:   sensorMsg.Serialized,
+		}
+		env.SetCompression(topic.Codec())
+		seqs[topic.NameOut]++
+		messages, err := env.MarshalFragments(envelope.MaxMessageSize)
+		if err != nil {
+			slog.Error("failed to wrap sensor message", "topic", topic.NameOut, "error", err)
+			continue
+		}
+		for _, data := range messages {
+			if err := datachannel.Send(data); err != nil {
+				slog.Error("failed to send sensor message", "topic", topic.NameOut, "error", err)
+				break
+			}
+		}
+	}
+}
+
+// setTargetBitrate splits the estimated bandwidth between the video tracks.
+func (pc *PeerConnectionChannel) setTargetBitrate(bitrate int) {
+	select {
+	case <-pc.done:
+		return
+	default:
+	}
+	share := bitrate
+	if len(pc.videoSinks) > 0 {
+		share = bitrate / len(pc.videoSinks)
+	}
+	pc.logEstimate(bitrate, share, time.Now())
+	if len(pc.videoSinks) == 0 {
+		return
+	}
+	for sink, topic := range pc.videoSinks {
+		pc.hub.setSinkBitrate(topic, sink, share)
 	}
-	return nil
 }
 
-func checkImgSpec(cfg *config.Config) [2]int {
-	tmp := cfg.Topics[0].ImgSpec
+// logEstimate logs the bandwidth estimate when it changed by more than
+// estimateLogThreshold since the last log, or every estimateLogInterval.
+func (pc *PeerConnectionChannel) logEstimate(bitrate, share int, now time.Time) {
+	pc.estimateMu.Lock()
+	defer pc.estimateMu.Unlock()
+	changed := abs(bitrate-pc.loggedEstimate) > int(float64(pc.loggedEstimate)*estimateLogThreshold)
+	if !changed && now.Sub(pc.lastEstimateLog) < estimateLogInterval {
+		return
+	}
+	slog.Info("bandwidth estimate", "bitrate", bitrate, "video_tracks", len(pc.videoSinks), "track_bitrate", share)
+	pc.loggedEstimate = bitrate
+	pc.lastEstimateLog = now
+}
 
-	width, height := 640, 480
-	if tmp.Width != 0 && tmp.Height!= 0 {
-		width = tmp.Width
-		height = tmp.Height
+// dataChannelInit derives the reliability of a topic's data channel from its
+// qos: best effort topics are neither ordered nor retransmitted, and reliable
+// topics with a lifespan stop retransmitting messages once they expire.
+func dataChannelInit(qos *rclgo.QosProfile) *webrtc.DataChannelInit {
+	ordered := true
+	init := &webrtc.DataChannelInit{Ordered: &ordered}
+	if qos.Reliability == rclgo.ReliabilityBestEffort {
+		ordered = false
+		maxRetransmits := uint16(0)
+		init.MaxRetransmits = &maxRetransmits
+		return init
 	}
-	return [2]int{
-		width,
-		height,
+	if qos.Lifespan > 0 && qos.Lifespan != rclgo.DurationInfinite {
+		lifetime := uint16(min(qos.Lifespan.Milliseconds(), math.MaxUint16))
+		init.MaxPacketLifeTime = &lifetime
+	}
+	return init
+}
+
+// expireFragments discards the incomplete messages of reassembler every
+// reassemblyTimeout until done is closed, so that a topic that stopped
+// sending doesn't keep its fragments.
+func expireFragments(reassembler *envelope.Reassembler, done <-chan struct{}) {
+	ticker := time.NewTicker(reassemblyTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			reassembler.Expire(now)
+		case <-done:
+			return
+		}
 	}
 }
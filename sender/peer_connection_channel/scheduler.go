@@ -0,0 +1,137 @@
+package peerconnectionchannel
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/3DRX/webrtc-ros-bridge/dropcount"
+	send_roschannel "github.com/3DRX/webrtc-ros-bridge/sender/ros_channel"
+)
+
+const (
+	// messages queued per priority before the oldest ones are dropped
+	schedulerQueueSize = 32
+	// data channels buffering more than this only get high priority messages
+	maxBufferedAmount = 1 << 20
+	// congested data channels accept messages again once below this
+	lowBufferedAmount = maxBufferedAmount / 2
+)
+
+// priority levels in scheduling order
+var priorities = []string{config.PriorityHigh, config.PriorityNormal, config.PriorityLow}
+
+// sensorScheduler queues the sensor messages of one peer connection by
+// priority. Higher priority messages are always taken first, and messages of
+// a congested topic are held back unless they have high priority.
+type sensorScheduler struct {
+	mu     sync.Mutex
+	queues map[string][]send_roschannel.TopicMessage // priority -> FIFO
+	wake   chan struct{}
+	drops  map[*config.TopicConfig]*dropcount.Counter
+}
+
+func newSensorScheduler() *sensorScheduler {
+	queues := make(map[string][]send_roschannel.TopicMessage)
+	for _, p := range priorities {
+		queues[p] = make([]send_roschannel.TopicMessage, 0, schedulerQueueSize)
+	}
+	return &sensorScheduler{
+		queues: queues,
+		wake:   make(chan struct{}, 1),
+		drops:  make(map[*config.TopicConfig]*dropcount.Counter),
+	}
+}
+
+func priorityOf(topic *config.TopicConfig) string {
+	if topic.Priority == "" {
+		return config.PriorityNormal
+	}
+	return topic.Priority
+}
+
+// push queues a message, dropping the oldest message of its priority when
+// the queue is full. Drops are counted per topic and reported while they go
+// on, and once the receiver caught up.
+func (s *sensorScheduler) push(msg send_roschannel.TopicMessage) {
+	p := priorityOf(msg.Topic)
+	s.mu.Lock()
+	queue := s.queues[p]
+	if len(queue) >= schedulerQueueSize {
+		topic := queue[0].Topic
+		drops, ok := s.drops[topic]
+		if !ok {
+			drops = &dropcount.Counter{}
+			s.drops[topic] = drops
+		}
+		if dropped := drops.Drop(time.Now()); dropped > 0 {
+			slog.Warn("receiver is behind, dropped oldest messages", "topic", topic.NameOut, "priority", priorityOf(topic), "dropped", dropped)
+		}
+		queue = queue[1:]
+	}
+	s.queues[p] = append(queue, msg)
+	s.mu.Unlock()
+	s.notify()
+}
+
+// notify wakes up a pending next call, e.g. once a data channel is no
+// longer congested.
+func (s *sensorScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the oldest message of the highest priority that can be sent
+// now, waiting for one until done is closed.
+func (s *sensorScheduler) next(congested func(*config.TopicConfig) bool, done <-chan struct{}) (send_roschannel.TopicMessage, bool) {
+	for {
+		if msg, ok := s.take(congested); ok {
+			return msg, true
+		}
+		select {
+		case <-s.wake:
+		case <-done:
+			return send_roschannel.TopicMessage{}, false
+		}
+	}
+}
+
+func (s *sensorScheduler) take(congested func(*config.TopicConfig) bool) (send_roschannel.TopicMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range priorities {
+		queue := s.queues[p]
+		for i, msg := range queue {
+			if p != config.PriorityHigh && congested(msg.Topic) {
+				continue
+			}
+			s.queues[p] = append(queue[:i], queue[i+1:]...)
+			if s.empty() {
+				s.reportDrops(time.Now())
+			}
+			return msg, true
+		}
+	}
+	return send_roschannel.TopicMessage{}, false
+}
+
+func (s *sensorScheduler) empty() bool {
+	for _, queue := range s.queues {
+		if len(queue) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reportDrops logs the messages dropped per topic since the last report.
+func (s *sensorScheduler) reportDrops(now time.Time) {
+	for topic, drops := range s.drops {
+		if drops.Pending() > 0 {
+			slog.Warn("receiver caught up, dropped oldest messages", "topic", topic.NameOut, "priority", priorityOf(topic), "dropped", drops.Flush(now))
+		}
+	}
+}
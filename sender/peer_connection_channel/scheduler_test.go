@@ -0,0 +1,66 @@
+package peerconnectionchannel
+
+import (
+	"testing"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	send_roschannel "github.com/3DRX/webrtc-ros-bridge/sender/ros_channel"
+)
+
+func TestSensorScheduler(t *testing.T) {
+	high := &config.TopicConfig{NameOut: "control", Priority: config.PriorityHigh}
+	normal := &config.TopicConfig{NameOut: "scan", Priority: config.PriorityNormal}
+	low := &config.TopicConfig{NameOut: "map", Priority: config.PriorityLow}
+	done := make(chan struct{})
+	notCongested := func(*config.TopicConfig) bool { return false }
+
+	s := newSensorScheduler()
+	s.push(send_roschannel.TopicMessage{Topic: low})
+	s.push(send_roschannel.TopicMessage{Topic: normal})
+	s.push(send_roschannel.TopicMessage{Topic: high})
+	for _, want := range []*config.TopicConfig{high, normal, low} {
+		msg, ok := s.next(notCongested, done)
+		if !ok || msg.Topic != want {
+			t.Fatalf("got %s, want %s", msg.Topic.NameOut, want.NameOut)
+		}
+	}
+
+	// congested topics only let high priority messages through
+	s.push(send_roschannel.TopicMessage{Topic: normal})
+	s.push(send_roschannel.TopicMessage{Topic: high})
+	allCongested := func(*config.TopicConfig) bool { return true }
+	if msg, ok := s.next(allCongested, done); !ok || msg.Topic != high {
+		t.Fatalf("got %s, want %s", msg.Topic.NameOut, high.NameOut)
+	}
+	if _, ok := s.take(allCongested); ok {
+		t.Fatal("took a message of a congested topic")
+	}
+	if msg, ok := s.next(notCongested, done); !ok || msg.Topic != normal {
+		t.Fatalf("got %s, want %s", msg.Topic.NameOut, normal.NameOut)
+	}
+
+	// full queues drop their oldest messages, the first drop is reported
+	// right away and the next ones once the receiver catches up
+	for i := 0; i < schedulerQueueSize+2; i++ {
+		s.push(send_roschannel.TopicMessage{Topic: low, Serialized: []byte{byte(i)}})
+	}
+	if s.drops[low].Total() != 2 || s.drops[low].Pending() != 1 {
+		t.Fatalf("%d drops counted and %d pending, want 2 and 1", s.drops[low].Total(), s.drops[low].Pending())
+	}
+	msg, ok := s.next(notCongested, done)
+	if !ok || msg.Serialized[0] != 2 {
+		t.Fatalf("got message %v, want the oldest ones dropped", msg.Serialized)
+	}
+	for i := 1; i < schedulerQueueSize; i++ {
+		s.next(notCongested, done)
+	}
+	if s.drops[low].Pending() != 0 {
+		t.Fatalf("%d drops not reported once caught up", s.drops[low].Pending())
+	}
+
+	close(done)
+	s = newSensorScheduler()
+	if _, ok := s.next(notCongested, done); ok {
+		t.Fatal("got a message after done")
+	}
+}
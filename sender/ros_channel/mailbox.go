@@ -0,0 +1,86 @@
+package roschannel
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/3DRX/webrtc-ros-bridge/dropcount"
+)
+
+// Mailboxes hold the latest message of every topic until it is taken, so
+// that subscription callbacks never wait for a slow consumer: a message not
+// taken before the next one arrives on its topic is replaced by it.
+type Mailboxes struct {
+	mu      sync.Mutex
+	boxes   map[*config.TopicConfig]*mailbox
+	waiting []*config.TopicConfig // topics with a message, oldest first
+	ready   chan struct{}
+}
+
+type mailbox struct {
+	msg   *TopicMessage
+	drops dropcount.Counter
+}
+
+func NewMailboxes() *Mailboxes {
+	return &Mailboxes{
+		boxes: make(map[*config.TopicConfig]*mailbox),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Put stores msg in the mailbox of its topic, replacing the message waiting
+// there, if any. It never blocks.
+func (m *Mailboxes) Put(msg TopicMessage) {
+	m.mu.Lock()
+	box, ok := m.boxes[msg.Topic]
+	if !ok {
+		box = &mailbox{}
+		m.boxes[msg.Topic] = box
+	}
+	if box.msg != nil {
+		if dropped := box.drops.Drop(time.Now()); dropped > 0 {
+			slog.Info("consumer is behind, replacing messages", "topic", msg.Topic.NameIn, "dropped", dropped)
+		}
+	} else {
+		m.waiting = append(m.waiting, msg.Topic)
+	}
+	box.msg = &msg
+	m.mu.Unlock()
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Take waits for a message and returns it, taking the topics in the order
+// their mailboxes were filled.
+func (m *Mailboxes) Take() TopicMessage {
+	for {
+		m.mu.Lock()
+		if len(m.waiting) > 0 {
+			topic := m.waiting[0]
+			m.waiting = m.waiting[1:]
+			box := m.boxes[topic]
+			msg := box.msg
+			box.msg = nil
+			m.mu.Unlock()
+			return *msg
+		}
+		m.mu.Unlock()
+		<-m.ready
+	}
+}
+
+// Dropped returns the number of messages of a topic replaced before they
+// were taken.
+func (m *Mailboxes) Dropped(topic *config.TopicConfig) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if box, ok := m.boxes[topic]; ok {
+		return box.drops.Total()
+	}
+	return 0
+}
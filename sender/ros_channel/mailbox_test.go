@@ -0,0 +1,37 @@
+package roschannel
+
+import (
+	"testing"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+)
+
+func TestMailboxesKeepLatest(t *testing.T) {
+	scan := &config.TopicConfig{NameIn: "scan"}
+	odom := &config.TopicConfig{NameIn: "odom"}
+	m := NewMailboxes()
+	m.Put(TopicMessage{Topic: scan, Serialized: []byte{0}})
+	m.Put(TopicMessage{Topic: odom, Serialized: []byte{1}})
+	m.Put(TopicMessage{Topic: scan, Serialized: []byte{2}})
+
+	msg := m.Take()
+	if msg.Topic != scan || msg.Serialized[0] != 2 {
+		t.Errorf("expected the latest scan first, got %s %v", msg.Topic.NameIn, msg.Serialized)
+	}
+	msg = m.Take()
+	if msg.Topic != odom || msg.Serialized[0] != 1 {
+		t.Errorf("expected odom, got %s %v", msg.Topic.NameIn, msg.Serialized)
+	}
+	if m.Dropped(scan) != 1 || m.Dropped(odom) != 0 {
+		t.Errorf("expected 1 dropped scan and no dropped odom, got %d and %d", m.Dropped(scan), m.Dropped(odom))
+	}
+
+	taken := make(chan TopicMessage)
+	go func() {
+		taken <- m.Take()
+	}()
+	m.Put(TopicMessage{Topic: odom, Serialized: []byte{3}})
+	if msg := <-taken; msg.Topic != odom || msg.Serialized[0] != 3 {
+		t.Errorf("expected the new odom, got %s %v", msg.Topic.NameIn, msg.Serialized)
+	}
+}
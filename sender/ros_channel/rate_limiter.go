@@ -0,0 +1,104 @@
+package roschannel
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+	"github.com/3DRX/webrtc-ros-bridge/dropcount"
+)
+
+// rateLimiter decimates the messages of a topic to every keep_every_n-th one,
+// then forwards at most one message per 1/max_rate_hz interval: the first
+// message after a quiet interval goes through right away, and of the messages
+// arriving faster only the latest is forwarded once the interval is over.
+type rateLimiter struct {
+	topic      string
+	interval   time.Duration // 0 disables the rate limit
+	keepEveryN uint64        // 0 or 1 keeps every message
+	forward    func(TopicMessage)
+
+	mu       sync.Mutex
+	received uint64
+	last     time.Time     // time the last message was forwarded
+	pending  *TopicMessage // latest message waiting for the interval to end
+	timer    *time.Timer
+	drops    dropcount.Counter
+}
+
+// newRateLimiter returns nil when the topic is neither rate limited nor
+// decimated.
+func newRateLimiter(topicCfg *config.TopicConfig, forward func(TopicMessage)) *rateLimiter {
+	if topicCfg.MaxRateHz == 0 && topicCfg.KeepEveryN <= 1 {
+		return nil
+	}
+	l := &rateLimiter{
+		topic:      topicCfg.NameIn,
+		keepEveryN: uint64(topicCfg.KeepEveryN),
+		forward:    forward,
+	}
+	if topicCfg.MaxRateHz > 0 {
+		l.interval = time.Duration(float64(time.Second) / topicCfg.MaxRateHz)
+	}
+	return l
+}
+
+// offer forwards msg now, once the current interval is over, or never.
+func (l *rateLimiter) offer(msg TopicMessage) {
+	l.mu.Lock()
+	l.received++
+	if l.keepEveryN > 1 && (l.received-1)%l.keepEveryN != 0 {
+		l.drop()
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.pending == nil && now.Sub(l.last) >= l.interval {
+		l.last = now
+		l.mu.Unlock()
+		l.forward(msg)
+		return
+	}
+	if l.pending != nil {
+		l.drop() // superseded by msg
+	} else {
+		l.timer = time.AfterFunc(l.last.Add(l.interval).Sub(now), l.flush)
+	}
+	l.pending = &msg
+	l.mu.Unlock()
+}
+
+func (l *rateLimiter) flush() {
+	l.mu.Lock()
+	msg := l.pending
+	l.pending = nil
+	l.timer = nil
+	l.last = time.Now()
+	l.mu.Unlock()
+	l.forward(*msg)
+}
+
+// stop discards the pending message, if any.
+func (l *rateLimiter) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.timer != nil && l.timer.Stop() {
+		l.pending = nil
+		l.timer = nil
+	}
+}
+
+// Dropped returns the number of messages dropped so far.
+func (l *rateLimiter) Dropped() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.drops.Total()
+}
+
+// drop counts a dropped message, l.mu must be held.
+func (l *rateLimiter) drop() {
+	if dropped := l.drops.Drop(time.Now()); dropped > 0 {
+		slog.Info("rate limiting topic", "topic", l.topic, "dropped", dropped)
+	}
+}
@@ -0,0 +1,51 @@
+package roschannel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+)
+
+func TestRateLimiterKeepsEveryN(t *testing.T) {
+	var forwarded []byte
+	l := newRateLimiter(&config.TopicConfig{NameIn: "odom", KeepEveryN: 3}, func(msg TopicMessage) {
+		forwarded = append(forwarded, msg.Serialized[0])
+	})
+	for i := 0; i < 7; i++ {
+		l.offer(TopicMessage{Serialized: []byte{byte(i)}})
+	}
+	if string(forwarded) != string([]byte{0, 3, 6}) {
+		t.Errorf("expected messages 0, 3 and 6, got %v", forwarded)
+	}
+	if l.Dropped() != 4 {
+		t.Errorf("expected 4 dropped messages, got %d", l.Dropped())
+	}
+}
+
+func TestRateLimiterForwardsLatest(t *testing.T) {
+	forwarded := make(chan byte, 10)
+	l := newRateLimiter(&config.TopicConfig{NameIn: "scan", MaxRateHz: 20}, func(msg TopicMessage) {
+		forwarded <- msg.Serialized[0]
+	})
+	for i := 0; i < 5; i++ {
+		l.offer(TopicMessage{Serialized: []byte{byte(i)}})
+	}
+	if got := <-forwarded; got != 0 {
+		t.Errorf("expected the first message right away, got %d", got)
+	}
+	select {
+	case got := <-forwarded:
+		if got != 4 {
+			t.Errorf("expected the latest message after the interval, got %d", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("latest message not forwarded")
+	}
+	if l.Dropped() != 3 {
+		t.Errorf("expected 3 dropped messages, got %d", l.Dropped())
+	}
+	if newRateLimiter(&config.TopicConfig{KeepEveryN: 1}, nil) != nil {
+		t.Error("expected no rate limiter without limits")
+	}
+}
@@ -2,30 +2,57 @@ package roschannel
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"sync"
 
 	"github.com/3DRX/webrtc-ros-bridge/config"
-	"github.com/3DRX/webrtc-ros-bridge/consts"
-	geom_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/geometry_msgs/msg"
-	nav_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/nav_msgs/msg"
-	sensor_msgs_msg "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/sensor_msgs/msg"
+	"github.com/3DRX/webrtc-ros-bridge/registry"
 	"github.com/tiiuae/rclgo/pkg/rclgo"
 	"github.com/tiiuae/rclgo/pkg/rclgo/types"
-
-	// 导入Autoware消息类型
-	control_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/autoware_control_msgs/msg"
-	planning_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/autoware_planning_msgs/msg"
-	vehicle_msgs "github.com/3DRX/webrtc-ros-bridge/rclgo_gen/autoware_vehicle_msgs/msg"
 )
 
+// TopicMessage is a ROS message together with the config of the topic
+// it was received on.
+type TopicMessage struct {
+	Topic      *config.TopicConfig
+	Msg        types.Message
+	Serialized []byte // set instead of Msg for dynamically loaded types
+}
+
+// onDemandSubscription is a subscription spinning in its own wait set,
+// shared by every session that asked for its topic.
+type onDemandSubscription struct {
+	sub    *rclgo.Subscription
+	refs   int
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// topicPublisher publishes a topic the receivers send to the sender.
+type topicPublisher struct {
+	topic       *config.TopicConfig
+	typeSupport types.MessageTypeSupport
+	dynamic     bool // type support loaded at runtime, publish serialized only
+	pub         *rclgo.Publisher
+}
+
 type ROSChannel struct {
 	subscriptions []*rclgo.Subscription
+	publishers    []*topicPublisher
 	node          *rclgo.Node
+	mailboxes     *Mailboxes
+	onDemandMu    sync.Mutex
+	onDemand      map[*config.TopicConfig]*onDemandSubscription
 }
 
+// InitROSChannel subscribes to every configured topic except the image
+// topics, which are subscribed with SubscribeOnDemand once a receiver asks
+// for them, and publishes the topics sent by the receivers.
 func InitROSChannel(
 	cfg *config.Config,
-	messageChan chan<- types.Message,
+	mailboxes *Mailboxes,
 ) *ROSChannel {
 	nodeName := "webrtc_ros_bridge_" + cfg.Mode
 	slog.Info("creating node", "name", nodeName)
@@ -37,165 +64,188 @@ func InitROSChannel(
 	if err != nil {
 		panic(err)
 	}
-	// create subscriptions based on topic types
-	subs := make([]*rclgo.Subscription, len(cfg.Topics))
-	for i, topic := range cfg.Topics {
-		topicPath := "/" + cfg.Topics[i].NameIn
-		opts := &rclgo.SubscriptionOptions{Qos: *(topic.Qos)}
-
-		switch topic.Type {
-		case consts.MSG_IMAGE:
-			imgSub, err := sensor_msgs_msg.NewImageSubscription(
-				node,
-				topicPath,
-				opts,
-				func(msg *sensor_msgs_msg.Image, info *rclgo.MessageInfo, err error) {
-					messageChan <- msg
-				},
-			)
-			subs[i] = imgSub.Subscription
-			if err != nil {
-				panic(err)
-			}
-
-		case consts.MSG_LASER_SCAN:
-			laserScanSub, err := sensor_msgs_msg.NewLaserScanSubscription(
-				node,
-				topicPath,
-				opts,
-				func(msg *sensor_msgs_msg.LaserScan, info *rclgo.MessageInfo, err error) {
-					messageChan <- msg
-				},
-			)
-			subs[i] = laserScanSub.Subscription
-			if err != nil {
-				panic(err)
-			}
-
-		// Odometry类型的消息 - 运动学状态
-		case consts.MSG_KINEMATIC:
-			sub, err := nav_msgs.NewOdometrySubscription(
-				node,
-				topicPath,
-				opts,
-				func(msg *nav_msgs.Odometry, info *rclgo.MessageInfo, err error) {
-					messageChan <- msg
-				},
-			)
-			subs[i] = sub.Subscription
-			if err != nil {
-				panic(err)
-			}
-
-		// 带协方差的位姿
-		case consts.MSG_POSE_COV:
-			sub, err := geom_msgs.NewPoseWithCovarianceStampedSubscription(
-				node,
-				topicPath,
-				opts,
-				func(msg *geom_msgs.PoseWithCovarianceStamped, info *rclgo.MessageInfo, err error) {
-					messageChan <- msg
-				},
-			)
-			subs[i] = sub.Subscription
-			if err != nil {
-				panic(err)
-			}
-
-		// Autoware特定的消息类型 - 当生成绑定后取消注释
-		case consts.MSG_CONTROL_CMD:
-			sub, err := control_msgs.NewControlSubscription(
-				node,
-				topicPath,
-				opts,
-				func(msg *control_msgs.Control, info *rclgo.MessageInfo, err error) {
-					messageChan <- msg
-				},
-			)
-			subs[i] = sub.Subscription
-			if err != nil {
-				panic(err)
-			}
-
-		case consts.MSG_TRAJECTORY:
-			sub, err := planning_msgs.NewTrajectorySubscription(
-				node,
-				topicPath,
-				opts,
-				func(msg *planning_msgs.Trajectory, info *rclgo.MessageInfo, err error) {
-					messageChan <- msg
-				},
-			)
-			subs[i] = sub.Subscription
-			if err != nil {
-				panic(err)
-			}
+	r := &ROSChannel{
+		subscriptions: make([]*rclgo.Subscription, 0, len(cfg.Topics)),
+		node:          node,
+		mailboxes:     mailboxes,
+		onDemand:      make(map[*config.TopicConfig]*onDemandSubscription),
+	}
+	for i := range cfg.Topics {
+		topicCfg := &cfg.Topics[i]
+		if !topicCfg.SubscribedBy(cfg.Mode) {
+			r.publishers = append(r.publishers, newTopicPublisher(node, topicCfg))
+			continue
+		}
+		if topicCfg.IsVideo() {
+			continue
+		}
+		sub, err := r.subscribe(context.Background(), topicCfg)
+		if err != nil {
+			panic(err)
+		}
+		r.subscriptions = append(r.subscriptions, sub)
+	}
+	return r
+}
 
-		case consts.MSG_CONTROL_MODE:
-			sub, err := vehicle_msgs.NewControlModeReportSubscription(
-				node,
-				topicPath,
-				opts,
-				func(msg *vehicle_msgs.ControlModeReport, info *rclgo.MessageInfo, err error) {
-					messageChan <- msg
-				},
-			)
-			subs[i] = sub.Subscription
-			if err != nil {
-				panic(err)
-			}
+func newTopicPublisher(node *rclgo.Node, topicCfg *config.TopicConfig) *topicPublisher {
+	opts := &rclgo.PublisherOptions{Qos: *(topicCfg.Qos)}
+	ts, ok := registry.Lookup(topicCfg.Type)
+	var pub *rclgo.Publisher
+	var err error
+	if ok {
+		pub, err = registry.NewPublisher(node, "/"+topicCfg.NameOut, topicCfg.Type, opts)
+	} else {
+		pub, err = registry.NewDynamicPublisher(node, "/"+topicCfg.NameOut, topicCfg.Type, opts)
+	}
+	if err != nil {
+		panic(err)
+	}
+	slog.Info("created publisher", "topic", pub.TopicName, "type", topicCfg.Type)
+	return &topicPublisher{
+		topic:       topicCfg,
+		typeSupport: ts,
+		dynamic:     !ok,
+		pub:         pub,
+	}
+}
 
-		case consts.MSG_VELOCITY:
-			sub, err := vehicle_msgs.NewVelocityReportSubscription(
-				node,
-				topicPath,
-				opts,
-				func(msg *vehicle_msgs.VelocityReport, info *rclgo.MessageInfo, err error) {
-					messageChan <- msg
-				},
-			)
-			subs[i] = sub.Subscription
-			if err != nil {
-				panic(err)
-			}
+// Publish publishes a serialized message a receiver sent on a topic, which
+// is matched against name_in.
+func (r *ROSChannel) Publish(topic string, msgType string, serialized []byte) error {
+	for _, p := range r.publishers {
+		if p.topic.NameIn != topic {
+			continue
+		}
+		if p.topic.Type != msgType {
+			return fmt.Errorf("type mismatch, expected %s", p.topic.Type)
+		}
+		if p.dynamic {
+			return p.pub.PublishSerialized(serialized)
+		}
+		msg, err := rclgo.Deserialize(serialized, p.typeSupport)
+		if err != nil {
+			return err
+		}
+		return p.pub.Publish(msg)
+	}
+	return errors.New("topic not configured")
+}
 
-		case consts.MSG_STEERING:
-			sub, err := vehicle_msgs.NewSteeringReportSubscription(
-				node,
-				topicPath,
-				opts,
-				func(msg *vehicle_msgs.SteeringReport, info *rclgo.MessageInfo, err error) {
-					messageChan <- msg
-				},
-			)
-			subs[i] = sub.Subscription
-			if err != nil {
-				panic(err)
-			}
+// SubscribeOnDemand subscribes to a topic until every SubscribeOnDemand call
+// for it is matched by an Unsubscribe. It can be called while spinning.
+func (r *ROSChannel) SubscribeOnDemand(topicCfg *config.TopicConfig) error {
+	r.onDemandMu.Lock()
+	defer r.onDemandMu.Unlock()
+	if s, ok := r.onDemand[topicCfg]; ok {
+		s.refs++
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := r.subscribe(ctx, topicCfg)
+	if err != nil {
+		cancel()
+		return err
+	}
+	ws, err := rclgo.NewWaitSet()
+	if err != nil {
+		cancel()
+		sub.Close()
+		return err
+	}
+	ws.AddSubscriptions(sub)
+	s := &onDemandSubscription{
+		sub:    sub,
+		refs:   1,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		defer ws.Close()
+		ws.Run(ctx)
+	}()
+	r.onDemand[topicCfg] = s
+	return nil
+}
 
-		case consts.MSG_GEAR:
-			sub, err := vehicle_msgs.NewGearReportSubscription(
-				node,
-				topicPath,
-				opts,
-				func(msg *vehicle_msgs.GearReport, info *rclgo.MessageInfo, err error) {
-					messageChan <- msg
-				},
-			)
-			subs[i] = sub.Subscription
-			if err != nil {
-				panic(err)
-			}
+// Unsubscribe releases a subscription made with SubscribeOnDemand.
+func (r *ROSChannel) Unsubscribe(topicCfg *config.TopicConfig) {
+	r.onDemandMu.Lock()
+	defer r.onDemandMu.Unlock()
+	s, ok := r.onDemand[topicCfg]
+	if !ok {
+		return
+	}
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	delete(r.onDemand, topicCfg)
+	s.cancel()
+	<-s.done
+	if err := s.sub.Close(); err != nil {
+		slog.Error("failed to close subscription", "topic", topicCfg.NameIn, "error", err)
+	}
+	slog.Info("unsubscribed", "topic", "/"+topicCfg.NameIn)
+}
 
-		default:
-			slog.Warn("unsupported topic type", "type", topic.Type)
-			continue // 跳过不支持的类型
+// subscribe creates a subscription whose callback puts messages in the
+// topic's mailbox, rate limited according to the topic config, until ctx is
+// done. The callback never blocks, so that a slow consumer can't hold up the
+// wait set.
+func (r *ROSChannel) subscribe(ctx context.Context, topicCfg *config.TopicConfig) (*rclgo.Subscription, error) {
+	topicPath := "/" + topicCfg.NameIn
+	opts := &rclgo.SubscriptionOptions{Qos: *(topicCfg.Qos)}
+	deliver := func(msg TopicMessage) {
+		if ctx.Err() != nil {
+			return
 		}
+		r.mailboxes.Put(msg)
 	}
-	return &ROSChannel{
-		subscriptions: subs,
-		node:          node,
+	if l := newRateLimiter(topicCfg, deliver); l != nil {
+		deliver = l.offer
+		context.AfterFunc(ctx, l.stop)
 	}
+	if !registry.IsSupported(topicCfg.Type) {
+		// no generated bindings, pass the serialized CDR through
+		sub, err := registry.SubscribeSerialized(
+			r.node,
+			topicPath,
+			topicCfg.Type,
+			opts,
+			func(msg []byte, info *rclgo.MessageInfo, err error) {
+				if err != nil {
+					slog.Error("failed to take message", "topic", topicPath, "error", err)
+					return
+				}
+				deliver(TopicMessage{Topic: topicCfg, Serialized: msg})
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("subscribed with dynamic type support", "topic", topicPath, "type", topicCfg.Type)
+		return sub, nil
+	}
+	sub, err := registry.Subscribe(
+		r.node,
+		topicPath,
+		topicCfg.Type,
+		opts,
+		func(msg types.Message, info *rclgo.MessageInfo, err error) {
+			if err != nil {
+				slog.Error("failed to take message", "topic", topicPath, "error", err)
+				return
+			}
+			deliver(TopicMessage{Topic: topicCfg, Msg: msg})
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("subscribed", "topic", topicPath, "type", topicCfg.Type)
+	return sub, nil
 }
 
 func (r *ROSChannel) Spin() {
@@ -204,6 +254,9 @@ func (r *ROSChannel) Spin() {
 		for _, sub := range r.subscriptions {
 			sub.Close()
 		}
+		for _, p := range r.publishers {
+			p.pub.Close()
+		}
 	}()
 	ws, err := rclgo.NewWaitSet()
 	if err != nil {
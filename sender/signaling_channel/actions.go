@@ -0,0 +1,189 @@
+package signalingchannel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"slices"
+	"strings"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+)
+
+// prefix of the add_video_track sources naming a ROS image topic
+const rosImageSrcPrefix = "ros_image:"
+
+type Action struct {
+	Type    string                   `json:"type"`
+	Actions []map[string]interface{} `json:"actions"`
+}
+
+type AddStreamAction struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type AddVideoTrackAction struct {
+	Type     string `json:"type"`
+	Id       string `json:"id"`
+	StreamId string `json:"stream_id"`
+	SrcId    string `json:"src"`
+}
+
+type RemoveStreamAction struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+// VideoTrack is a video track the receiver asked for, bound to the image
+// topic of its source.
+type VideoTrack struct {
+	Id       string
+	StreamId string
+	Topic    *config.TopicConfig
+}
+
+// VideoTracks applies the actions of a configure message in order and returns
+// the video tracks of the streams left at the end. Actions that can't be
+// applied, e.g. tracks of unknown sources, are skipped and reported in errs.
+func (a *Action) VideoTracks(cfg *config.Config) (tracks []VideoTrack, errs []error) {
+	if a.Type != "configure" {
+		return nil, []error{fmt.Errorf("invalid action type \"%s\"", a.Type)}
+	}
+	streams := make(map[string][]VideoTrack)
+	streamOrder := []string{}
+	for _, rawAction := range a.Actions {
+		actionType, _ := rawAction["type"].(string)
+		switch actionType {
+		case "add_stream":
+			action := AddStreamAction{}
+			if err := unmarshalAction(rawAction, &action); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if _, ok := streams[action.Id]; ok {
+				errs = append(errs, fmt.Errorf("stream \"%s\" already exists", action.Id))
+				continue
+			}
+			streams[action.Id] = []VideoTrack{}
+			streamOrder = append(streamOrder, action.Id)
+		case "add_video_track":
+			action := AddVideoTrackAction{}
+			if err := unmarshalAction(rawAction, &action); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if _, ok := streams[action.StreamId]; !ok {
+				errs = append(errs, fmt.Errorf("stream \"%s\" of track \"%s\" doesn't exist", action.StreamId, action.Id))
+				continue
+			}
+			topic, err := imageTopicOf(cfg, action.SrcId)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			streams[action.StreamId] = append(streams[action.StreamId], VideoTrack{
+				Id:       action.Id,
+				StreamId: action.StreamId,
+				Topic:    topic,
+			})
+		case "remove_stream":
+			action := RemoveStreamAction{}
+			if err := unmarshalAction(rawAction, &action); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if _, ok := streams[action.Id]; !ok {
+				errs = append(errs, fmt.Errorf("stream \"%s\" doesn't exist", action.Id))
+				continue
+			}
+			delete(streams, action.Id)
+			streamOrder = slices.DeleteFunc(streamOrder, func(id string) bool { return id == action.Id })
+		default:
+			errs = append(errs, fmt.Errorf("unsupported action type \"%s\"", actionType))
+		}
+	}
+	requested := make(map[*config.TopicConfig]bool)
+	for _, id := range streamOrder {
+		for _, track := range streams[id] {
+			// every topic is encoded once, so it can't back more than one track
+			if requested[track.Topic] {
+				errs = append(errs, fmt.Errorf("source of track \"%s\" is already requested", track.Id))
+				continue
+			}
+			requested[track.Topic] = true
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks, errs
+}
+
+// SetROIMessage asks the sender to change the part of the images of the
+// topic of a video track the video shows, at any time after the answer. A
+// zero width or height restores the configured crop.
+type SetROIMessage struct {
+	Type   string `json:"type"` // "set_roi"
+	SrcId  string `json:"src"`  // source of the track, as in add_video_track
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// ROIRequest is a set_roi message bound to the image topic it crops.
+type ROIRequest struct {
+	Topic *config.TopicConfig
+	Crop  image.Rectangle // empty to restore the configured crop
+}
+
+// ROIRequest checks that the message crops the topic of one of tracks.
+func (m *SetROIMessage) ROIRequest(cfg *config.Config, tracks []VideoTrack) (ROIRequest, error) {
+	if m.X < 0 || m.Y < 0 || m.Width < 0 || m.Height < 0 {
+		return ROIRequest{}, fmt.Errorf("invalid ROI %dx%d at (%d, %d)", m.Width, m.Height, m.X, m.Y)
+	}
+	topic, err := imageTopicOf(cfg, m.SrcId)
+	if err != nil {
+		return ROIRequest{}, err
+	}
+	for _, track := range tracks {
+		if track.Topic == topic {
+			return ROIRequest{
+				Topic: topic,
+				Crop:  image.Rect(m.X, m.Y, m.X+m.Width, m.Y+m.Height),
+			}, nil
+		}
+	}
+	return ROIRequest{}, fmt.Errorf("source \"%s\" isn't requested", m.SrcId)
+}
+
+// imageTopicOf finds the configured image topic named by a "ros_image:/topic" source.
+func imageTopicOf(cfg *config.Config, src string) (*config.TopicConfig, error) {
+	name, ok := strings.CutPrefix(src, rosImageSrcPrefix)
+	if !ok {
+		return nil, fmt.Errorf("unsupported source \"%s\"", src)
+	}
+	name = strings.TrimPrefix(name, "/")
+	for i := range cfg.Topics {
+		topic := &cfg.Topics[i]
+		if topic.IsVideo() && topic.NameIn == name {
+			return topic, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown source \"%s\"", src)
+}
+
+func unmarshalAction(rawAction interface{}, action interface{}) error {
+	rawActionMap, ok := rawAction.(map[string]interface{})
+	if !ok {
+		return errors.New("Invalid action type")
+	}
+	rawActionBytes, err := json.Marshal(rawActionMap)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(rawActionBytes, action); err != nil {
+		return err
+	}
+	return nil
+}
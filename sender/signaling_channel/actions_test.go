@@ -0,0 +1,190 @@
+package signalingchannel
+
+import (
+	"image"
+	"testing"
+
+	"github.com/3DRX/webrtc-ros-bridge/config"
+)
+
+func TestVideoTracks(t *testing.T) {
+	cfg := &config.Config{
+		Mode: "sender",
+		Topics: []config.TopicConfig{
+			{NameIn: "image_front", NameOut: "image_front", Type: "sensor_msgs/msg/Image"},
+			{NameIn: "image_rear", NameOut: "image_rear", Type: "sensor_msgs/msg/Image"},
+			{NameIn: "scan", NameOut: "scan", Type: "sensor_msgs/msg/LaserScan"},
+		},
+	}
+	addStream := func(id string) map[string]interface{} {
+		return map[string]interface{}{"type": "add_stream", "id": id}
+	}
+	addTrack := func(streamId, id, src string) map[string]interface{} {
+		return map[string]interface{}{"type": "add_video_track", "stream_id": streamId, "id": id, "src": src}
+	}
+	removeStream := func(id string) map[string]interface{} {
+		return map[string]interface{}{"type": "remove_stream", "id": id}
+	}
+	tests := []struct {
+		name       string
+		action     Action
+		wantTracks []string
+		wantErrs   int
+	}{
+		{
+			name: "single track",
+			action: Action{Type: "configure", Actions: []map[string]interface{}{
+				addStream("s"),
+				addTrack("s", "t1", "ros_image:/image_front"),
+			}},
+			wantTracks: []string{"t1"},
+		},
+		{
+			name: "tracks across streams",
+			action: Action{Type: "configure", Actions: []map[string]interface{}{
+				addStream("a"),
+				addStream("b"),
+				addTrack("a", "t1", "ros_image:/image_front"),
+				addTrack("b", "t2", "ros_image:image_rear"),
+			}},
+			wantTracks: []string{"t1", "t2"},
+		},
+		{
+			name: "removed stream",
+			action: Action{Type: "configure", Actions: []map[string]interface{}{
+				addStream("a"),
+				addTrack("a", "t1", "ros_image:/image_front"),
+				removeStream("a"),
+				addStream("b"),
+				addTrack("b", "t2", "ros_image:/image_rear"),
+			}},
+			wantTracks: []string{"t2"},
+		},
+		{
+			name: "re-added stream",
+			action: Action{Type: "configure", Actions: []map[string]interface{}{
+				addStream("s"),
+				removeStream("s"),
+				addStream("s"),
+				addTrack("s", "t1", "ros_image:/image_front"),
+			}},
+			wantTracks: []string{"t1"},
+		},
+		{
+			name: "unknown sources",
+			action: Action{Type: "configure", Actions: []map[string]interface{}{
+				addStream("s"),
+				addTrack("s", "t1", "ros_image:/missing"),
+				addTrack("s", "t2", "ros_image:/scan"),
+				addTrack("s", "t3", "camera:/dev/video0"),
+				addTrack("s", "t4", "ros_image:/image_front"),
+			}},
+			wantTracks: []string{"t4"},
+			wantErrs:   3,
+		},
+		{
+			name: "track of missing stream",
+			action: Action{Type: "configure", Actions: []map[string]interface{}{
+				addTrack("s", "t1", "ros_image:/image_front"),
+			}},
+			wantErrs: 1,
+		},
+		{
+			name: "duplicated source",
+			action: Action{Type: "configure", Actions: []map[string]interface{}{
+				addStream("s"),
+				addTrack("s", "t1", "ros_image:/image_front"),
+				addTrack("s", "t2", "ros_image:/image_front"),
+			}},
+			wantTracks: []string{"t1"},
+			wantErrs:   1,
+		},
+		{
+			name: "unsupported action",
+			action: Action{Type: "configure", Actions: []map[string]interface{}{
+				{"type": "add_audio_track"},
+			}},
+			wantErrs: 1,
+		},
+		{
+			name:     "not a configure message",
+			action:   Action{Type: "ice_candidate"},
+			wantErrs: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracks, errs := tt.action.VideoTracks(cfg)
+			if len(errs) != tt.wantErrs {
+				t.Errorf("got %d errors %v, want %d", len(errs), errs, tt.wantErrs)
+			}
+			if len(tracks) != len(tt.wantTracks) {
+				t.Fatalf("got %d tracks, want %d", len(tracks), len(tt.wantTracks))
+			}
+			for i, track := range tracks {
+				if track.Id != tt.wantTracks[i] {
+					t.Errorf("track %d: got id %s, want %s", i, track.Id, tt.wantTracks[i])
+				}
+			}
+		})
+	}
+}
+
+func TestROIRequest(t *testing.T) {
+	cfg := &config.Config{
+		Mode: "sender",
+		Topics: []config.TopicConfig{
+			{NameIn: "image_front", NameOut: "image_front", Type: "sensor_msgs/msg/Image"},
+			{NameIn: "image_rear", NameOut: "image_rear", Type: "sensor_msgs/msg/Image"},
+		},
+	}
+	tracks := []VideoTrack{{Id: "t1", StreamId: "s", Topic: &cfg.Topics[0]}}
+	tests := []struct {
+		name     string
+		msg      SetROIMessage
+		wantCrop image.Rectangle
+		wantErr  bool
+	}{
+		{
+			name:     "crop",
+			msg:      SetROIMessage{Type: "set_roi", SrcId: "ros_image:/image_front", X: 100, Y: 50, Width: 640, Height: 480},
+			wantCrop: image.Rect(100, 50, 740, 530),
+		},
+		{
+			name: "reset",
+			msg:  SetROIMessage{Type: "set_roi", SrcId: "ros_image:/image_front"},
+		},
+		{
+			name:    "negative offset",
+			msg:     SetROIMessage{Type: "set_roi", SrcId: "ros_image:/image_front", X: -1, Width: 640, Height: 480},
+			wantErr: true,
+		},
+		{
+			name:    "topic not requested",
+			msg:     SetROIMessage{Type: "set_roi", SrcId: "ros_image:/image_rear", Width: 640, Height: 480},
+			wantErr: true,
+		},
+		{
+			name:    "unknown source",
+			msg:     SetROIMessage{Type: "set_roi", SrcId: "ros_image:/image_side", Width: 640, Height: 480},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := tt.msg.ROIRequest(cfg, tracks)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if request.Topic != &cfg.Topics[0] {
+				t.Errorf("got topic %s, want image_front", request.Topic.NameIn)
+			}
+			if request.Crop != tt.wantCrop {
+				t.Errorf("got crop %v, want %v", request.Crop, tt.wantCrop)
+			}
+		})
+	}
+}
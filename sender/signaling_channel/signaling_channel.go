@@ -2,38 +2,54 @@ package signalingchannel
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
+	"sync"
 
 	"github.com/3DRX/webrtc-ros-bridge/config"
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 )
 
-type Action struct {
-	Type    string                   `json:"type"`
-	Actions []map[string]interface{} `json:"actions"`
+// ErrorMessage reports to the receiver a request the sender can't honor.
+type ErrorMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// ICECandidateJSON is an ICE candidate as sent by the receiver.
+type ICECandidateJSON struct {
+	Candidate     string `json:"candidate"`
+	SDPMid        string `json:"sdp_mid"`
+	SDPMLineIndex uint16 `json:"sdp_mline_index"`
+	Type          string `json:"type"`
 }
 
 type SignalingChannel struct {
-	cfg                 *config.Config
-	upgrader            *websocket.Upgrader
-	conn                *websocket.Conn
-	actions             *Action
-	haveReceiverPromise chan struct{}
-	sendSDPChan         <-chan webrtc.SessionDescription
-	recvSDPChan         chan<- webrtc.SessionDescription
-	sendCandidateChan   <-chan webrtc.ICECandidateInit
-	recvCandidateChan   chan<- webrtc.ICECandidateInit
-}
-
-func InitSignalingChannel(
-	cfg *config.Config,
-	sendSDPChan <-chan webrtc.SessionDescription,
-	recvSDPChan chan<- webrtc.SessionDescription,
-	sendCandidateChan <-chan webrtc.ICECandidateInit,
-	recvCandidateChan chan<- webrtc.ICECandidateInit,
-) *SignalingChannel {
+	cfg          *config.Config
+	upgrader     *websocket.Upgrader
+	receiversMu  sync.Mutex
+	receivers    map[*Receiver]struct{}
+	receiverChan chan *Receiver
+}
+
+// Receiver is the signaling session of one connected receiver. It lasts
+// until the websocket is closed from either side.
+type Receiver struct {
+	conn              *websocket.Conn
+	writeMu           sync.Mutex
+	videoTracks       []VideoTrack
+	sendSDPChan       chan webrtc.SessionDescription
+	recvSDPChan       chan webrtc.SessionDescription
+	sendCandidateChan chan webrtc.ICECandidateInit
+	recvCandidateChan chan webrtc.ICECandidateInit
+	roiChan           chan ROIRequest
+	done              chan struct{}
+	closeOnce         sync.Once
+}
+
+func InitSignalingChannel(cfg *config.Config) *SignalingChannel {
 	return &SignalingChannel{
 		cfg: cfg,
 		upgrader: &websocket.Upgrader{
@@ -41,32 +57,40 @@ func InitSignalingChannel(
 				return true
 			},
 		},
-		conn:                nil,
-		actions:             nil,
-		haveReceiverPromise: make(chan struct{}),
-		sendSDPChan:         sendSDPChan,
-		recvSDPChan:         recvSDPChan,
-		sendCandidateChan:   sendCandidateChan,
-		recvCandidateChan:   recvCandidateChan,
+		receivers:    make(map[*Receiver]struct{}),
+		receiverChan: make(chan *Receiver),
 	}
 }
 
-func (s *SignalingChannel) Spin() <-chan struct{} {
+// Spin serves the signaling endpoint and returns a channel yielding every
+// receiver once it has sent its configure message.
+func (s *SignalingChannel) Spin() <-chan *Receiver {
 	mux := http.NewServeMux()
 	mux.Handle("GET /webrtc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if s.conn != nil {
-			slog.Warn("already have a receiver, rejecting new connection")
+		s.receiversMu.Lock()
+		defer s.receiversMu.Unlock()
+		if len(s.receivers) >= s.cfg.MaxReceivers {
+			slog.Warn("too many receivers, rejecting new connection", "max_receivers", s.cfg.MaxReceivers)
 			w.WriteHeader(http.StatusConflict)
 			return
 		}
 		conn, err := s.upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			panic(err)
+			slog.Error("websocket upgrade error", "error", err)
+			return
 		}
-		slog.Info("new receiver connected")
-		s.conn = conn
-		go s.handleRecvMessages()
-		go s.handleSendMessages()
+		slog.Info("new receiver connected", "addr", conn.RemoteAddr())
+		receiver := newReceiver(conn)
+		s.receivers[receiver] = struct{}{}
+		go func() {
+			<-receiver.done
+			s.receiversMu.Lock()
+			delete(s.receivers, receiver)
+			s.receiversMu.Unlock()
+			slog.Info("receiver disconnected", "addr", conn.RemoteAddr())
+		}()
+		go receiver.handleRecvMessages(s.cfg, s.receiverChan)
+		go receiver.handleSendMessages()
 	}))
 
 	httpServer := &http.Server{
@@ -79,59 +103,97 @@ func (s *SignalingChannel) Spin() <-chan struct{} {
 			panic(err)
 		}
 	}()
-	return s.haveReceiverPromise
+	return s.receiverChan
 }
 
-func (s *SignalingChannel) handleSendMessages() {
+func newReceiver(conn *websocket.Conn) *Receiver {
+	return &Receiver{
+		conn:              conn,
+		videoTracks:       nil,
+		sendSDPChan:       make(chan webrtc.SessionDescription),
+		recvSDPChan:       make(chan webrtc.SessionDescription),
+		sendCandidateChan: make(chan webrtc.ICECandidateInit),
+		recvCandidateChan: make(chan webrtc.ICECandidateInit),
+		roiChan:           make(chan ROIRequest),
+		done:              make(chan struct{}),
+	}
+}
+
+func (r *Receiver) writeJSON(v interface{}) error {
+	jsonMsg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.conn.WriteMessage(websocket.TextMessage, jsonMsg)
+}
+
+func (r *Receiver) handleSendMessages() {
 	for {
 		select {
-		case sdp := <-s.sendSDPChan:
-			jsonMsg, err := json.Marshal(sdp)
-			if err != nil {
-				slog.Error("failed to marshal SDP", "error", err)
-			}
-			err = s.conn.WriteMessage(websocket.TextMessage, jsonMsg)
-			if err != nil {
-				slog.Error("websocket write error", "error", err)
+		case <-r.done:
+			return
+		case sdp := <-r.sendSDPChan:
+			if err := r.writeJSON(sdp); err != nil {
+				slog.Error("failed to send SDP", "error", err)
+				continue
 			}
 			slog.Info("sent SDP", "sdp", sdp.SDP)
-		case candidate := <-s.sendCandidateChan:
-			jsonMsg, err := json.Marshal(candidate)
-			if err != nil {
-				slog.Error("failed to marshal ICE candidate", "error", err)
-			}
-			err = s.conn.WriteMessage(websocket.TextMessage, jsonMsg)
-			if err != nil {
-				slog.Error("websocket write error", "error", err)
+		case candidate := <-r.sendCandidateChan:
+			if err := r.writeJSON(candidate); err != nil {
+				slog.Error("failed to send ICE candidate", "error", err)
+				continue
 			}
 			slog.Info("sent ICE candidate", "candidate", candidate)
 		}
 	}
 }
 
-func (s *SignalingChannel) handleRecvMessages() {
+func (r *Receiver) handleRecvMessages(cfg *config.Config, receiverChan chan<- *Receiver) {
+	defer r.Close()
+	configured := false
+	answered := false
 	for {
-		_, message, err := s.conn.ReadMessage()
+		_, message, err := r.conn.ReadMessage()
 		if err != nil {
 			slog.Error("websocket read error", "error", err)
 			return
 		}
-		if s.actions == nil {
+		if !configured {
 			// try to parse the message as an action
 			newAction := &Action{}
 			err := json.Unmarshal(message, newAction)
 			if err != nil {
 				slog.Warn("failed to parse message as action", "error", err)
+				r.SendError(err)
 				continue
 			}
 			slog.Info("received action", "action", newAction)
-			s.actions = newAction
-			s.haveReceiverPromise <- struct{}{}
-			_, message, err = s.conn.ReadMessage()
-			if err != nil {
-				slog.Error("websocket read error", "error", err)
+			videoTracks, errs := newAction.VideoTracks(cfg)
+			for _, err := range errs {
+				slog.Warn("rejected action", "error", err)
+				r.SendError(err)
+			}
+			if newAction.Type != "configure" {
+				continue
+			}
+			r.videoTracks = videoTracks
+			configured = true
+			select {
+			case receiverChan <- r:
+			case <-r.done:
 				return
 			}
+			continue
+		}
+		if action := (Action{}); json.Unmarshal(message, &action) == nil && action.Type == "configure" {
+			// the tracks of a session are negotiated once, in its first offer
+			slog.Warn("rejected configure message of a configured session")
+			r.SendError(errors.New("the video tracks of a session can't be changed, reconnect to configure them again"))
+			continue
+		}
+		if !answered {
 			// try to parse it as an SDP
 			newSDP := webrtc.SessionDescription{}
 			err = json.Unmarshal(message, &newSDP)
@@ -140,11 +202,91 @@ func (s *SignalingChannel) handleRecvMessages() {
 				continue
 			}
 			slog.Info("received SDP", "sdp", newSDP.SDP)
-			s.recvSDPChan <- newSDP
+			answered = true
+			select {
+			case r.recvSDPChan <- newSDP:
+			case <-r.done:
+				return
+			}
+			continue
+		}
+		roiMsg := SetROIMessage{}
+		if err := json.Unmarshal(message, &roiMsg); err == nil && roiMsg.Type == "set_roi" {
+			request, err := roiMsg.ROIRequest(cfg, r.videoTracks)
+			if err != nil {
+				slog.Warn("rejected ROI request", "error", err)
+				r.SendError(err)
+				continue
+			}
+			slog.Info("received ROI request", "topic", request.Topic.NameIn, "crop", request.Crop)
+			select {
+			case r.roiChan <- request:
+			case <-r.done:
+				return
+			}
+			continue
 		}
+		candidateJSON := ICECandidateJSON{}
+		if err := json.Unmarshal(message, &candidateJSON); err != nil || candidateJSON.Type != "ice_candidate" {
+			slog.Warn("ignoring unexpected message", "message", string(message))
+			continue
+		}
+		slog.Info("received ICE candidate", "candidate", candidateJSON)
+		select {
+		case r.recvCandidateChan <- webrtc.ICECandidateInit{
+			Candidate:     candidateJSON.Candidate,
+			SDPMid:        &candidateJSON.SDPMid,
+			SDPMLineIndex: &candidateJSON.SDPMLineIndex,
+		}:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// SendError reports err to the receiver with an error message.
+func (r *Receiver) SendError(err error) {
+	msg := ErrorMessage{Type: "error", Message: err.Error()}
+	if err := r.writeJSON(msg); err != nil {
+		slog.Error("failed to send error message", "error", err)
 	}
 }
 
-func (s *SignalingChannel) GetActions() *Action {
-	return s.actions
+// Close ends the session, closing the websocket.
+func (r *Receiver) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.conn.Close()
+	})
+}
+
+// Done is closed once the session has ended.
+func (r *Receiver) Done() <-chan struct{} {
+	return r.done
+}
+
+// GetVideoTracks returns the video tracks the receiver configured.
+func (r *Receiver) GetVideoTracks() []VideoTrack {
+	return r.videoTracks
+}
+
+func (r *Receiver) SendSDPChan() chan<- webrtc.SessionDescription {
+	return r.sendSDPChan
+}
+
+func (r *Receiver) RecvSDPChan() <-chan webrtc.SessionDescription {
+	return r.recvSDPChan
+}
+
+func (r *Receiver) SendCandidateChan() chan<- webrtc.ICECandidateInit {
+	return r.sendCandidateChan
+}
+
+func (r *Receiver) RecvCandidateChan() <-chan webrtc.ICECandidateInit {
+	return r.recvCandidateChan
+}
+
+// RecvROIChan yields the set_roi requests of the receiver.
+func (r *Receiver) RecvROIChan() <-chan ROIRequest {
+	return r.roiChan
 }